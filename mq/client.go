@@ -40,6 +40,22 @@ func (w Wait) String() string {
 	return strconv.Itoa(int(w))
 }
 
+// Delay is the number of seconds until a released message goes back onto the queue. Max is 604,800 (7 days)
+type Delay uint32
+
+// DelayFromInt returns a Delay representation of i if i is in range. Returns ErrDelayOutOfRange otherwise.
+func DelayFromInt(i int) (Delay, error) {
+	if i >= MinDelay && i <= MaxDelay {
+		return Delay(i), nil
+	}
+	return 0, ErrDelayOutOfRange
+}
+
+// String converts a delay value to a printable string
+func (d Delay) String() string {
+	return strconv.Itoa(int(d))
+}
+
 // WaitInRange determines whether the given Wait value is in the valid range
 func waitInRange(w Wait) bool {
 	return w <= MaxWait && w >= MinWait
@@ -50,6 +66,11 @@ func timeoutInRange(t Timeout) bool {
 	return t <= MaxTimeout && t >= MinTimeout
 }
 
+// DelayInRange determines whether the given Delay value is in the valid range
+func delayInRange(d Delay) bool {
+	return d <= MaxDelay && d >= MinDelay
+}
+
 const (
 	// MinTimeout is the minimum value for a Timeout
 	MinTimeout = 30
@@ -59,6 +80,31 @@ const (
 	MinWait = 0
 	// MaxWait is the maximum value for a wait
 	MaxWait = 30
+	// MinDelay is the minimum value for a Delay
+	MinDelay = 0
+	// MaxDelay is the maximum value for a Delay
+	MaxDelay = 604800
+	// MaxPeek is the maximum number of messages that can be peeked at once
+	MaxPeek = 100
+	// MaxEnqueueBatch is the maximum number of messages that IronMQ accepts in a single enqueue
+	// request
+	MaxEnqueueBatch = 100
+	// MaxEnqueueBatchBytes is the maximum total size of the message bodies that IronMQ accepts
+	// in a single enqueue request
+	MaxEnqueueBatchBytes = 256 * 1024
+	// QueueTypePull is the type of pull queues, which messages are reserved from
+	QueueTypePull = "pull"
+	// QueueTypeMulticast is the type of push queues that push each message to all subscribers
+	QueueTypeMulticast = "multicast"
+	// QueueTypeUnicast is the type of push queues that push each message to one subscriber
+	QueueTypeUnicast = "unicast"
+	// SuggestedBatchBytes is the total body size that SuggestBatchSize keeps batches under. It
+	// leaves 10% of MaxEnqueueBatchBytes as headroom for messages that are bigger than average
+	SuggestedBatchBytes = MaxEnqueueBatchBytes * 9 / 10
+	// EnqueueMsgOverheadBytes is roughly how many bytes each message adds to an enqueue request
+	// on top of its body and the keys and values of its push headers, for its JSON syntax and
+	// delay. HTTPClient.Enqueue counts it against the batch byte budget too
+	EnqueueMsgOverheadBytes = 64
 )
 
 var (
@@ -66,12 +112,28 @@ var (
 	ErrTimeoutOutOfRange = fmt.Errorf("timeout out of range [%d, %d]", MinTimeout, MaxTimeout)
 	// ErrWaitOutOfRange is returned when a Wait is given that's out of the [MinWait, MaxTimeout] range
 	ErrWaitOutOfRange = fmt.Errorf("wait out of range [%d, %d]", MinWait, MaxWait)
+	// ErrDelayOutOfRange is returned when a Delay is given that's out of the [MinDelay, MaxDelay] range
+	ErrDelayOutOfRange = fmt.Errorf("delay out of range [%d, %d]", MinDelay, MaxDelay)
 	// ErrNoSuchReservation is returned from funcs that accept a reservation ID
 	// when the ID doesn't exist
 	ErrNoSuchReservation = errors.New("no such reservation")
 	// ErrNoSuchMessage is returned from funcs that accept a message ID when the
 	// ID doesn't exist
 	ErrNoSuchMessage = errors.New("no such message")
+	// ErrNoSuchQueue is returned from funcs that accept a queue name when the
+	// queue doesn't exist
+	ErrNoSuchQueue = errors.New("no such queue")
+	// ErrAlreadyRedelivered is returned from DeleteReserved when the reservation expired before
+	// the delete, so the message went back onto the queue and may already have been reserved by
+	// another consumer. The message is still on the queue, and whoever holds it now is
+	// responsible for it, so the caller can stop processing it without treating this as a failure
+	ErrAlreadyRedelivered = errors.New("reservation expired and message was redelivered")
+	// ErrInvalidMessageID is returned from Enqueue when a NewMessage has an ID that's too long or
+	// has characters other than letters, digits, '-' and '_'
+	ErrInvalidMessageID = fmt.Errorf("message ID must be at most %d letters, digits, '-' or '_'", MaxMessageIDLen)
+	// ErrPushQueue is returned from Dequeue by HTTPClients created with WithPushQueueGuard
+	// when the queue is a push queue (see QueueInfo.IsPush)
+	ErrPushQueue = errors.New("can't reserve messages from a push queue")
 )
 
 // Enqueued is the result of the Enqueue func
@@ -80,6 +142,17 @@ type Enqueued struct {
 	IDs []string `json:"ids"`
 	// Msg is the resulting status of the enqueue operation
 	Msg string `json:"msg"`
+	// QueueSize is the size of the queue right after the messages were enqueued, which lets
+	// producers apply backpressure without calling GetQueueInfo. It's best-effort: it's nil if
+	// the server didn't report the size, which IronMQ itself currently doesn't. When an
+	// HTTPClient splits the messages into several requests, it's the size reported for the last
+	// one
+	QueueSize *int `json:"size,omitempty"`
+	// URLs are the API URLs of the enqueued messages, in the same order as IDs, for logging or
+	// for making requests about the messages later. They never contain the token, even if the
+	// client sends it in the query (see WithTokenInQuery), so requests to them need to be
+	// authenticated like any other. They're only set by HTTPClients created with WithMessageURLs
+	URLs []string `json:"-"`
 }
 
 // Deleted is the result of the DeleteReserved func
@@ -87,6 +160,71 @@ type Deleted struct {
 	Msg string `json:"msg"`
 }
 
+// Released is the result of the ReleaseReserved func
+type Released struct {
+	Msg string `json:"msg"`
+}
+
+// Touched is the result of the TouchReserved func
+type Touched struct {
+	// ReservationID is the new reservation ID of the message. The old one is no longer valid
+	ReservationID string `json:"reservation_id"`
+	Msg           string `json:"msg"`
+}
+
+// QueueConfig is the configuration of a queue that PutQueue creates or updates. Zero values are
+// left out, so that the server keeps the current setting or uses its default
+type QueueConfig struct {
+	// Type is the type of the queue, such as "pull"
+	Type string `json:"type,omitempty"`
+	// MessageTimeout is the default reservation timeout of messages on the queue, in seconds
+	MessageTimeout int `json:"message_timeout,omitempty"`
+	// MessageExpiration is how long messages stay on the queue before they're discarded, in seconds
+	MessageExpiration int `json:"message_expiration,omitempty"`
+}
+
+// QueueInfo is the result of the GetQueueInfo func
+type QueueInfo struct {
+	// Name is the name of the queue
+	Name string `json:"name"`
+	// ProjectID is the ID of the project the queue belongs to
+	ProjectID string `json:"project_id"`
+	// Size is the number of messages currently on the queue, including reserved ones
+	Size int `json:"size"`
+	// TotalMessages is the number of messages that have ever been enqueued onto the queue
+	TotalMessages int `json:"total_messages"`
+	// Type is the type of the queue, one of the QueueType constants. It's empty if the server
+	// didn't report it
+	Type string `json:"type,omitempty"`
+	// Push is the push configuration of the queue, which only push queues have
+	Push *PushInfo `json:"push,omitempty"`
+}
+
+// IsPush returns true if the queue is a push queue, which IronMQ delivers messages from by
+// pushing them to its subscribers. That's the case if its type is QueueTypeMulticast or
+// QueueTypeUnicast, or if it has subscribers. Reserving messages from a push queue competes with
+// the pushes, so it's usually a misconfiguration
+func (q QueueInfo) IsPush() bool {
+	if q.Type == QueueTypeMulticast || q.Type == QueueTypeUnicast {
+		return true
+	}
+	return q.Push != nil && len(q.Push.Subscribers) > 0
+}
+
+// PushInfo is the push configuration of a push queue
+type PushInfo struct {
+	// Subscribers are the endpoints that messages are pushed to
+	Subscribers []Subscriber `json:"subscribers"`
+}
+
+// Subscriber is an endpoint that a push queue pushes messages to
+type Subscriber struct {
+	// Name identifies the subscriber within the queue
+	Name string `json:"name"`
+	// URL is where messages are pushed to
+	URL string `json:"url"`
+}
+
 // Client is an interface for communicating with the IronMQ service.
 type Client interface {
 	// Enqueue enqueues msgs onto qName. if ctx.Done() receives before the enqueue
@@ -94,7 +232,10 @@ type Client interface {
 	// return no messages and a non-nil error.
 	//
 	// Note that clients need not roll back a partially applied enqueue operation if
-	// ctx.Done() received before it completely finished
+	// ctx.Done() received before it completely finished.
+	//
+	// Returns nil and ErrInvalidMessageID without enqueueing anything if any of msgs has an ID
+	// that isn't valid (see NewMessage.ID)
 	Enqueue(ctx context.Context, token, projID, qName string, msgs []NewMessage) (*Enqueued, error)
 
 	// Dequeue dequeues at most num messages from qName or until wait expires.
@@ -116,10 +257,66 @@ type Client interface {
 	// Returns nil and an error if ctx.Done() receives before the delete operation succeeds.
 	//
 	// Returns nil and ErrNoSuchReservation if reservationID refers to a reservation that doesn't exist in the queue.
+	// Returns nil and ErrAlreadyRedelivered instead if the reservation expired but the message
+	// is still on the queue, as far as the client can tell.
 	//
 	// Finally, returns nil and a non-nil error if any other error occurs.
 	//
 	// Note that clients need not roll back a partially applied delete operation
 	// if ctx.Done() received before it finished
 	DeleteReserved(ctx context.Context, token, projID, qName string, messageID int, reservationID string) (*Deleted, error)
+
+	// ReleaseReserved releases the reserved message with the given message ID and reservation ID
+	// so that it goes back onto the queue with the given name after delay. Use it to hand a message
+	// back without waiting for its reservation to time out.
+	//
+	// Returns nil and ErrNoSuchReservation if reservationID refers to a reservation that doesn't
+	// exist in the queue, and nil and ErrDelayOutOfRange if delay is out of range. Otherwise returns
+	// nil and a non-nil error if ctx.Done() receives before the release operation succeeds or any
+	// other error occurs.
+	ReleaseReserved(ctx context.Context, token, projID, qName string, messageID int, reservationID string, delay Delay) (*Released, error)
+
+	// TouchReserved extends the reservation of the reserved message with the given message ID and
+	// reservation ID so that it times out after timeout from now. The message gets a new
+	// reservation ID, which is returned, and the old one can't be used anymore.
+	//
+	// Returns nil and ErrNoSuchReservation if reservationID refers to a reservation that doesn't
+	// exist in the queue, and nil and ErrTimeoutOutOfRange if timeout is out of range. Otherwise
+	// returns nil and a non-nil error if ctx.Done() receives before the touch operation succeeds
+	// or any other error occurs.
+	TouchReserved(ctx context.Context, token, projID, qName string, messageID int, reservationID string, timeout Timeout) (*Touched, error)
+
+	// Peek returns at most num of the messages at the front of qName that are available to be
+	// reserved, without reserving them. num is capped at MaxPeek.
+	//
+	// Reserved messages are never returned. The IronMQ v3 API has no way to list the messages
+	// that are currently reserved or when their reservations expire, so Client can't offer one
+	// either. When diagnosing stuck reservations, the number of reserved messages in a small
+	// queue is the Size from GetQueueInfo minus the number of messages Peek returns, as long as
+	// that's less than MaxPeek
+	//
+	// Returns nil and a non-nil error if ctx.Done() receives before the operation succeeds or any
+	// other error occurs.
+	Peek(ctx context.Context, token, projID, qName string, num int) ([]Message, error)
+
+	// MessageExists returns true if the message with the given ID is on qName, whether it's
+	// available or reserved, without returning the message itself. Returns false if neither the
+	// message nor the queue exist.
+	//
+	// Returns false and a non-nil error if ctx.Done() receives before the operation succeeds or
+	// any other error occurs.
+	MessageExists(ctx context.Context, token, projID, qName string, messageID int) (bool, error)
+
+	// PutQueue creates the queue with the given name and config if it doesn't exist, and updates
+	// its config otherwise. Returns information about the queue.
+	//
+	// Returns nil and a non-nil error if ctx.Done() receives before the operation succeeds or any
+	// other error occurs.
+	PutQueue(ctx context.Context, token, projID, qName string, cfg QueueConfig) (*QueueInfo, error)
+
+	// GetQueueInfo returns information about the queue with the given name, including its size.
+	//
+	// Returns nil and ErrNoSuchQueue if the queue doesn't exist, and nil and a non-nil error if
+	// ctx.Done() receives before the operation succeeds or any other error occurs.
+	GetQueueInfo(ctx context.Context, token, projID, qName string) (*QueueInfo, error)
 }
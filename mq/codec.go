@@ -0,0 +1,124 @@
+package mq
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+)
+
+// HeaderBodyCodec is the push header that names the BodyCodec a message body was encoded with
+const HeaderBodyCodec = "X-Gorion-Codec"
+
+// BodyCodec compresses message bodies before they're enqueued and decompresses them after
+// they're reserved. Implementations must be safe for concurrent use. GzipCodec is built in, and
+// other algorithms such as zstd or snappy can be plugged in by implementing this interface around
+// the library of your choice
+type BodyCodec interface {
+	// Name identifies the codec in the HeaderBodyCodec push header of encoded messages. It must
+	// be the same on the enqueueing and the consuming side
+	Name() string
+	// Encode compresses b
+	Encode(b []byte) ([]byte, error)
+	// Decode decompresses b, which was returned from Encode
+	Decode(b []byte) ([]byte, error)
+}
+
+// GzipCodec is a BodyCodec that compresses with gzip at the default compression level. It's
+// always available to DecodeBody, so consumers don't need to be configured for it
+type GzipCodec struct{}
+
+// Name is the interface implementation
+func (GzipCodec) Name() string {
+	return "gzip"
+}
+
+// Encode is the interface implementation
+func (GzipCodec) Encode(b []byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	w := gzip.NewWriter(buf)
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decode is the interface implementation
+func (GzipCodec) Decode(b []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// UnknownCodecError is returned from DecodeBody when a message was encoded with a codec that
+// isn't available
+type UnknownCodecError struct {
+	// Name is the name of the codec in the message's HeaderBodyCodec push header
+	Name string
+}
+
+// Error is the error interface implementation
+func (u *UnknownCodecError) Error() string {
+	return fmt.Sprintf("unknown body codec [%s]", u.Name)
+}
+
+// encodeBody returns msg with its body encoded with codec and base64, and the codec's name in
+// its push headers. msg's push headers aren't modified
+func encodeBody(msg NewMessage, codec BodyCodec) (NewMessage, error) {
+	enc, err := codec.Encode([]byte(msg.Body))
+	if err != nil {
+		return msg, err
+	}
+	headers := make(map[string]string, len(msg.PushHeaders)+1)
+	for k, v := range msg.PushHeaders {
+		headers[k] = v
+	}
+	headers[HeaderBodyCodec] = codec.Name()
+	msg.Body = base64.StdEncoding.EncodeToString(enc)
+	msg.PushHeaders = headers
+	return msg, nil
+}
+
+// DecodeBody returns the decoded body of msg. If msg wasn't encoded with a BodyCodec, which is
+// the case if it has no HeaderBodyCodec push header, its body is returned as is. Otherwise the
+// codec named in the header is looked up among codecs, falling back to GzipCodec, and returns
+// an *UnknownCodecError if it isn't found.
+//
+// Since the codec is only known from the push headers, messages dequeued from servers that don't
+// return push headers along with reserved messages can't be decoded
+func DecodeBody(msg DequeuedMessage, codecs ...BodyCodec) (string, error) {
+	name, ok := msg.PushHeaders[HeaderBodyCodec]
+	if !ok {
+		return msg.Body, nil
+	}
+	var codec BodyCodec
+	// codecs isn't appended to, since callers like ConsumeRouted share it between goroutines
+	for _, c := range codecs {
+		if c.Name() == name {
+			codec = c
+			break
+		}
+	}
+	if codec == nil && name == (GzipCodec{}).Name() {
+		codec = GzipCodec{}
+	}
+	if codec == nil {
+		return "", &UnknownCodecError{Name: name}
+	}
+	enc, err := base64.StdEncoding.DecodeString(msg.Body)
+	if err != nil {
+		return "", err
+	}
+	dec, err := codec.Decode(enc)
+	if err != nil {
+		return "", err
+	}
+	return string(dec), nil
+}
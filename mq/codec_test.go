@@ -0,0 +1,81 @@
+package mq
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/arschles/assert"
+)
+
+// reverseCodec is a BodyCodec that reverses bodies, which is enough to tell whether it was used
+type reverseCodec struct{}
+
+func (reverseCodec) Name() string { return "reverse" }
+
+func (reverseCodec) Encode(b []byte) ([]byte, error) {
+	ret := make([]byte, len(b))
+	for i, c := range b {
+		ret[len(b)-1-i] = c
+	}
+	return ret, nil
+}
+
+func (r reverseCodec) Decode(b []byte) ([]byte, error) {
+	return r.Encode(b)
+}
+
+func TestBodyCodecs(t *testing.T) {
+	msg := NewMessage{Body: strings.Repeat("abc", 100), PushHeaders: map[string]string{"a": "b"}}
+	for _, codec := range []BodyCodec{GzipCodec{}, reverseCodec{}} {
+		enc, err := encodeBody(msg, codec)
+		assert.NoErr(t, err)
+		assert.Equal(t, enc.PushHeaders[HeaderBodyCodec], codec.Name(), "codec header")
+		assert.Equal(t, enc.PushHeaders["a"], "b", "existing push header")
+		assert.Equal(t, len(msg.PushHeaders), 1, "number of push headers of the original message")
+		dq := DequeuedMessage{Body: enc.Body, PushHeaders: enc.PushHeaders}
+		body, err := DecodeBody(dq, reverseCodec{})
+		assert.NoErr(t, err)
+		assert.Equal(t, body, msg.Body, "decoded body")
+	}
+
+	enc, err := encodeBody(msg, reverseCodec{})
+	assert.NoErr(t, err)
+	_, err = DecodeBody(DequeuedMessage{Body: enc.Body, PushHeaders: enc.PushHeaders})
+	codecErr, ok := err.(*UnknownCodecError)
+	assert.True(t, ok, "returned error [%v] was not an *UnknownCodecError", err)
+	assert.Equal(t, codecErr.Name, "reverse", "unknown codec name")
+
+	body, err := DecodeBody(DequeuedMessage{Body: "plain"})
+	assert.NoErr(t, err)
+	assert.Equal(t, body, "plain", "body without a codec")
+}
+
+func BenchmarkGzipCodec(b *testing.B) {
+	// JSON-like bodies compress a lot better than random bytes, so repeat a typical payload
+	payload := []byte(`{"id":12345,"type":"order.created","customer":"c-6789","items":[{"sku":"a-1","qty":2}]}`)
+	for _, size := range []int{256, 4 * 1024, 64 * 1024} {
+		body := bytes.Repeat(payload, size/len(payload)+1)[:size]
+		enc, err := GzipCodec{}.Encode(body)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(fmt.Sprintf("encode-%d", size), func(b *testing.B) {
+			b.SetBytes(int64(size))
+			for i := 0; i < b.N; i++ {
+				if _, err := (GzipCodec{}).Encode(body); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("decode-%d", size), func(b *testing.B) {
+			b.SetBytes(int64(size))
+			for i := 0; i < b.N; i++ {
+				if _, err := (GzipCodec{}).Decode(enc); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -2,6 +2,7 @@ package mq
 
 import (
 	"fmt"
+	"strconv"
 
 	"golang.org/x/net/context"
 )
@@ -48,3 +49,69 @@ func qOperations(cl Client) error {
 	}
 	return nil
 }
+
+// deleteAfterRedelivery checks that deleting a message with a reservation that's no longer
+// valid returns ErrAlreadyRedelivered while the message is still on the queue
+func deleteAfterRedelivery(cl Client) error {
+	ctx := context.Background()
+	if _, err := cl.Enqueue(ctx, token, projID, qName, []NewMessage{{Body: "123", PushHeaders: make(map[string]string)}}); err != nil {
+		return fmt.Errorf("got error on enqueue [%s]", err)
+	}
+	first, err := cl.Dequeue(ctx, token, projID, qName, 1, Timeout(30), Wait(1), false)
+	if err != nil || len(first) != 1 {
+		return fmt.Errorf("dequeue returned [%d] messages and error [%v]", len(first), err)
+	}
+	// releasing the message has the same effect as its reservation timing out
+	if _, err := cl.ReleaseReserved(ctx, token, projID, qName, first[0].ID, first[0].ReservationID, 0); err != nil {
+		return fmt.Errorf("got error on release [%s]", err)
+	}
+	second, err := cl.Dequeue(ctx, token, projID, qName, 1, Timeout(30), Wait(1), false)
+	if err != nil || len(second) != 1 {
+		return fmt.Errorf("dequeue returned [%d] messages and error [%v]", len(second), err)
+	}
+	if _, err := cl.DeleteReserved(ctx, token, projID, qName, first[0].ID, first[0].ReservationID); err != ErrAlreadyRedelivered {
+		return fmt.Errorf("delete with the expired reservation returned [%v], expected ErrAlreadyRedelivered", err)
+	}
+	if _, err := cl.DeleteReserved(ctx, token, projID, qName, second[0].ID, second[0].ReservationID); err != nil {
+		return fmt.Errorf("delete with the current reservation returned error [%s]", err)
+	}
+	return nil
+}
+
+// messageExists checks that MessageExists finds messages while they're available or reserved,
+// and not after they were deleted
+func messageExists(cl Client) error {
+	ctx := context.Background()
+	enq, err := cl.Enqueue(ctx, token, projID, qName, []NewMessage{{Body: "123", PushHeaders: make(map[string]string)}})
+	if err != nil {
+		return fmt.Errorf("got error on enqueue [%s]", err)
+	}
+	id, err := strconv.Atoi(enq.IDs[0])
+	if err != nil {
+		return fmt.Errorf("enqueued ID [%s] isn't an int", enq.IDs[0])
+	}
+	check := func(state string, expected bool) error {
+		exists, err := cl.MessageExists(ctx, token, projID, qName, id)
+		if err != nil {
+			return fmt.Errorf("MessageExists for %s message returned error [%s]", state, err)
+		}
+		if exists != expected {
+			return fmt.Errorf("MessageExists for %s message returned [%t]", state, exists)
+		}
+		return nil
+	}
+	if err := check("available", true); err != nil {
+		return err
+	}
+	msgs, err := cl.Dequeue(ctx, token, projID, qName, 1, Timeout(30), Wait(1), false)
+	if err != nil || len(msgs) != 1 {
+		return fmt.Errorf("dequeue returned [%d] messages and error [%v]", len(msgs), err)
+	}
+	if err := check("reserved", true); err != nil {
+		return err
+	}
+	if _, err := cl.DeleteReserved(ctx, token, projID, qName, msgs[0].ID, msgs[0].ReservationID); err != nil {
+		return fmt.Errorf("got error on delete [%s]", err)
+	}
+	return check("deleted", false)
+}
@@ -0,0 +1,763 @@
+package mq
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+var (
+	// ErrAlreadySettled is returned from Ack funcs when the message was already acked or nacked
+	ErrAlreadySettled = errors.New("message already settled")
+	// ErrNoDeadLetterQueue is reported when a message should be dead lettered but
+	// ConsumeOptions.DeadLetterQueue is empty
+	ErrNoDeadLetterQueue = errors.New("no dead letter queue configured")
+	// ErrNoHandlers is returned from ConsumeRouted when there's no queue to consume from
+	ErrNoHandlers = errors.New("no handlers to consume with")
+)
+
+// Action is what a typed consumer does with a message whose body it couldn't decode
+type Action int
+
+const (
+	// ActionDelete deletes the message from the queue
+	ActionDelete Action = iota
+	// ActionRelease releases the message back onto the queue so that it's redelivered
+	ActionRelease
+	// ActionDeadLetter enqueues the message onto ConsumeOptions.DeadLetterQueue and then deletes
+	// it from the queue
+	ActionDeadLetter
+)
+
+// String converts an Action to a printable string
+func (a Action) String() string {
+	switch a {
+	case ActionDelete:
+		return "delete"
+	case ActionRelease:
+		return "release"
+	case ActionDeadLetter:
+		return "dead letter"
+	default:
+		return "unknown"
+	}
+}
+
+// consumeErrBackoff is how long a consumer waits before its next reserve request after one fails
+const consumeErrBackoff = time.Second
+
+// Ack is handed to a Handler along with each message, and lets the handler settle the message
+// itself: Ack deletes it from the queue and Nack releases it so that it can be reserved again.
+// Only the first call to either func has any effect.
+//
+// If the handler doesn't settle the message, the consumer does it after the handler returns,
+// acking the message if the handler returned nil and nacking it otherwise. In ConsumeOptions.ManualAck
+// mode the consumer never does, and the Ack may be kept and used after the handler returns
+type Ack struct {
+	cl     Client
+	token  string
+	projID string
+	qName  string
+	// the timeout that Touch extends the reservation by
+	timeout Timeout
+	// when msg was reserved, and where to report the time until it's deleted
+	reservedAt time.Time
+	metrics    MetricsRecorder
+	// returns a new expiry timer for msg, whose reservation was extended at the given time, if
+	// non-nil. Touch uses it to replace expiry
+	watch func(msg DequeuedMessage, from time.Time) *time.Timer
+
+	// held while touching, so that settling never uses a reservation ID that's about to change
+	mtx     sync.Mutex
+	msg     DequeuedMessage
+	settled bool
+	// fires opts.OnReservationExpiring for msg, if non-nil. It's stopped when msg is settled
+	expiry *time.Timer
+}
+
+func newAck(cl Client, token, projID, qName string, msg DequeuedMessage, timeout Timeout, reservedAt time.Time, metrics MetricsRecorder) *Ack {
+	return &Ack{cl: cl, token: token, projID: projID, qName: qName, msg: msg, timeout: timeout, reservedAt: reservedAt, metrics: metrics}
+}
+
+// settle marks the message as settled and returns true if it wasn't already
+func (a *Ack) settle() bool {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	if a.settled {
+		return false
+	}
+	a.settled = true
+	if a.expiry != nil {
+		a.expiry.Stop()
+	}
+	return true
+}
+
+// Message returns the message that the Ack settles, with its current reservation ID
+func (a *Ack) Message() DequeuedMessage {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	return a.msg
+}
+
+// Touch extends the reservation of the message by ConsumeOptions.Timeout, for handlers that need
+// longer than that. The Ack keeps the new reservation ID, so Ack and Nack keep working, and
+// ConsumeOptions.OnReservationExpiring is scheduled again for the new reservation. Returns
+// ErrAlreadySettled if the message was already acked or nacked, or the error from TouchReserved.
+//
+// Touch the message with Touch rather than with Client.TouchReserved, which leaves the Ack with
+// an outdated reservation ID
+func (a *Ack) Touch(ctx context.Context) error {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	if a.settled {
+		return ErrAlreadySettled
+	}
+	touched, err := a.cl.TouchReserved(ctx, a.token, a.projID, a.qName, a.msg.ID, a.msg.ReservationID, a.timeout)
+	if err != nil {
+		return err
+	}
+	a.msg.ReservationID = touched.ReservationID
+	if a.expiry != nil {
+		a.expiry.Stop()
+	}
+	if a.watch != nil {
+		a.expiry = a.watch(a.msg, time.Now())
+	}
+	return nil
+}
+
+// Ack deletes the message from the queue. Returns ErrAlreadySettled if the message was already
+// acked or nacked, or the error from DeleteReserved
+func (a *Ack) Ack(ctx context.Context) error {
+	if !a.settle() {
+		return ErrAlreadySettled
+	}
+	if _, err := a.cl.DeleteReserved(ctx, a.token, a.projID, a.qName, a.msg.ID, a.msg.ReservationID); err != nil {
+		return err
+	}
+	a.metrics.ObserveProcessed(a.qName, time.Since(a.reservedAt))
+	return nil
+}
+
+// deadLetter enqueues the message onto dlq in the same project and then acks it. If the enqueue
+// fails, the message isn't settled
+func (a *Ack) deadLetter(ctx context.Context, dlq string) error {
+	if dlq == "" {
+		return ErrNoDeadLetterQueue
+	}
+	a.mtx.Lock()
+	settled := a.settled
+	a.mtx.Unlock()
+	if settled {
+		return ErrAlreadySettled
+	}
+	headers := a.msg.PushHeaders
+	if headers == nil {
+		headers = make(map[string]string)
+	}
+	if _, err := a.cl.Enqueue(ctx, a.token, a.projID, dlq, []NewMessage{{Body: a.msg.Body, PushHeaders: headers}}); err != nil {
+		return err
+	}
+	return a.Ack(ctx)
+}
+
+// Nack releases the message back onto the queue, where it becomes available again after delay
+// seconds, so handlers can retry a message later. Returns ErrDelayOutOfRange without settling the
+// message if delay is out of range, ErrAlreadySettled if the message was already acked or
+// nacked, or the error from ReleaseReserved
+func (a *Ack) Nack(ctx context.Context, delay int) error {
+	d, err := DelayFromInt(delay)
+	if err != nil {
+		return err
+	}
+	if !a.settle() {
+		return ErrAlreadySettled
+	}
+	_, err = a.cl.ReleaseReserved(ctx, a.token, a.projID, a.qName, a.msg.ID, a.msg.ReservationID, d)
+	return err
+}
+
+// Handler processes a message that a consumer reserved. The message is acked if the handler
+// returns nil and nacked if it returns an error, unless the handler settled it with ack first
+// or the consumer is in ConsumeOptions.ManualAck mode
+type Handler func(ctx context.Context, msg DequeuedMessage, ack *Ack) error
+
+// DecodeError is the error a typed consumer reports when a message body couldn't be decoded
+type DecodeError struct {
+	// MessageID is the ID of the message that couldn't be decoded
+	MessageID int
+	// Err is the error from the decoder
+	Err error
+}
+
+// Error is the error interface implementation
+func (d *DecodeError) Error() string {
+	return fmt.Sprintf("couldn't decode body of message [%d] [%s]", d.MessageID, d.Err)
+}
+
+// HandlerTimeoutError is the error a consumer reports when a handler doesn't return within
+// ConsumeOptions.HandlerTimeout
+type HandlerTimeoutError struct {
+	// MessageID is the ID of the message the handler was handling
+	MessageID int
+	// Timeout is the timeout that the handler exceeded
+	Timeout time.Duration
+}
+
+// Error is the error interface implementation
+func (h *HandlerTimeoutError) Error() string {
+	return fmt.Sprintf("handler for message [%d] didn't return within [%s]", h.MessageID, h.Timeout)
+}
+
+// ConsumeOptions configures a consumer
+type ConsumeOptions struct {
+	// Num is the maximum number of messages to reserve at a time. Values less than 1 mean 1
+	Num int
+	// Timeout is the reservation timeout for every message the consumer reserves
+	Timeout Timeout
+	// Wait is how long each reserve request waits for messages to become available
+	Wait Wait
+	// OnError, if non-nil, is called with every error the consumer encounters but can't return,
+	// such as failed reserve requests, errors returned from the handler and failed acks and nacks
+	OnError func(error)
+	// OnDecodeError, if non-nil, is called by ConsumeTyped instead of the handler when a message
+	// body can't be decoded, and returns what to do with the message. If it's nil, undecodable
+	// messages are dead lettered if DeadLetterQueue is set and deleted otherwise, so that they're
+	// never redelivered forever. Either way, a *DecodeError is passed to OnError.
+	//
+	// If the action fails, for example because the message can't be enqueued onto the dead
+	// letter queue, the error is passed to OnError instead and the message is released, in
+	// ManualAck mode too. If it's the delete or release request of the action itself that
+	// fails, the message is redelivered once its reservation times out instead
+	OnDecodeError func(raw DequeuedMessage, err error) Action
+	// DeadLetterQueue is the name of the queue, in the same project, that ActionDeadLetter
+	// enqueues undecodable messages onto. Dead lettering fails with ErrNoDeadLetterQueue if
+	// it's empty
+	DeadLetterQueue string
+	// HandlerTimeout, if positive, is the maximum amount of time the handler may take for each
+	// message. The context passed to the handler is cancelled when it elapses, and if the handler
+	// still hasn't returned, the consumer nacks the message, passes a *HandlerTimeoutError to
+	// OnError and moves on to the next message without waiting for the handler any longer
+	HandlerTimeout time.Duration
+	// ManualAck, if true, stops the consumer from settling messages when the handler returns.
+	// Instead, the caller is responsible for calling Ack or Nack on every message's Ack, for
+	// example once the result of handling it has been durably stored elsewhere. The handler may
+	// hold on to the Ack after it returns, but messages whose reservations time out before they
+	// are acked go back onto the queue, and acking them afterward fails. Handler errors are
+	// still passed to OnError, and messages whose handlers time out are still nacked
+	ManualAck bool
+	// Codecs are the BodyCodecs, in addition to GzipCodec, that ConsumeTyped can decode message
+	// bodies with before JSON-decoding them (see DecodeBody). Bodies it can't decode are treated
+	// like bodies that aren't valid JSON
+	Codecs []BodyCodec
+	// MaxMsgsPerSec, if positive, is the maximum rate at which the consumer hands messages to
+	// the handler, spread out evenly over time. Messages that are reserved but still waiting for
+	// their turn are touched every half of Timeout so that their reservations don't expire. This
+	// limits the rate at which handling starts, so it's lower than MaxMsgsPerSec if the handler is
+	// slow
+	MaxMsgsPerSec float64
+	// TouchJitter spreads out the touches of reservations that are kept alive automatically, so
+	// that consumers that reserved messages at the same time don't all touch them at the same
+	// time. Each interval between touches is randomly lengthened or shortened by up to
+	// TouchJitter times the interval, so 0.1 means +/- 10%. It's clamped to [0, 0.25], so that a
+	// touch is never scheduled so late that the reservation expires first, and the default of 0
+	// means no jitter
+	TouchJitter float64
+	// GlobalMaxInFlight, if positive, is the maximum number of messages that the consumers of all
+	// the queues in ConsumeRouted hold at once, counting from when a message is reserved until its
+	// handler returns. When the limit is reached, every queue stops reserving until a handler
+	// returns, which keeps one busy queue from using up the memory budget of all of them. Each
+	// queue still reserves at most Num messages at a time, and fewer if there aren't Num free
+	// slots under the limit, so the limit only has an effect if it's less than Num times the
+	// number of queues.
+	//
+	// Slots are only held while reserving for reserve requests that don't wait, so that a queue
+	// that's empty doesn't keep the others from using them while it waits for messages. With a
+	// positive Wait, each queue's consumer first tries to reserve without waiting, and if its
+	// queue is empty, waits for at most as many messages as there are free slots. Messages that
+	// arrive while it waits, and that there are no free slots for anymore by the time they're
+	// reserved, are released right away. Consume and Stream ignore it
+	GlobalMaxInFlight int
+	// OnReservationExpiring, if non-nil, is called once for each message the consumer holds
+	// whose reservation is within ReservationExpiringWithin of expiring, along with the time
+	// that's left, so that the handler can prioritize, touch (see Ack.Touch) or give up on it
+	// before it's redelivered. A message is held from when it's reserved until it's acked or nacked, which
+	// in ManualAck mode can be after its handler returned. It's called from a goroutine of its
+	// own, and may rarely be called for a message that was settled just before. It's called
+	// again for the new reservation after every Ack.Touch, and the consumer takes its own
+	// touches into account too, but not touches made with Client.TouchReserved
+	OnReservationExpiring func(m DequeuedMessage, remaining time.Duration)
+	// ReservationExpiringWithin is how long before a reservation expires OnReservationExpiring
+	// is called. If it's not positive, it's a quarter of Timeout
+	ReservationExpiringWithin time.Duration
+	// Metrics, if non-nil, receives the processing time of every message the consumer deletes,
+	// which is the time from when the message was reserved until it was acked
+	Metrics MetricsRecorder
+}
+
+// decodeAction returns the action to take for raw, which couldn't be decoded because of err
+func (c ConsumeOptions) decodeAction(raw DequeuedMessage, err error) Action {
+	if c.OnDecodeError != nil {
+		return c.OnDecodeError(raw, err)
+	}
+	if c.DeadLetterQueue != "" {
+		return ActionDeadLetter
+	}
+	return ActionDelete
+}
+
+func (c ConsumeOptions) metrics() MetricsRecorder {
+	if c.Metrics == nil {
+		return NopMetrics{}
+	}
+	return c.Metrics
+}
+
+func (c ConsumeOptions) expiringWithin() time.Duration {
+	if c.ReservationExpiringWithin <= 0 {
+		return time.Duration(int(c.Timeout)) * time.Second / 4
+	}
+	return c.ReservationExpiringWithin
+}
+
+func (c ConsumeOptions) num() int {
+	if c.Num < 1 {
+		return 1
+	}
+	return c.Num
+}
+
+// Consumer reserves messages from a queue and calls a Handler with each one, one at a time. Use
+// NewConsumer or NewTypedConsumer to create one, or Consume and ConsumeTyped to create one and
+// run it right away
+type Consumer struct {
+	cl     Client
+	token  string
+	projID string
+	qName  string
+	opts   ConsumeOptions
+	h      Handler
+
+	// the UnixNano time of the last activity, accessed atomically
+	lastActivity int64
+	// the earliest time the next message may be handled when pacing to opts.MaxMsgsPerSec
+	nextTurn time.Time
+	// bounds the messages held by this and other consumers, if non-nil
+	inFlight slots
+}
+
+// slots is a semaphore that bounds the number of messages held by several consumers at once. A
+// nil slots doesn't bound anything
+type slots chan struct{}
+
+// acquire blocks until at least one slot is free, and then takes up to n free slots and returns
+// how many it took. Returns 0 if ctx.Done() received first
+func (s slots) acquire(ctx context.Context, n int) int {
+	if s == nil {
+		return n
+	}
+	select {
+	case <-ctx.Done():
+		return 0
+	case s <- struct{}{}:
+	}
+	taken := 1
+	for taken < n {
+		select {
+		case s <- struct{}{}:
+			taken++
+		default:
+			return taken
+		}
+	}
+	return taken
+}
+
+// free blocks until at least one slot is free, and then returns how many of up to n slots are
+// free, without taking any. Returns 0 if ctx.Done() received first
+func (s slots) free(ctx context.Context, n int) int {
+	if s == nil {
+		return n
+	}
+	select {
+	case <-ctx.Done():
+		return 0
+	case s <- struct{}{}:
+	}
+	free := cap(s) - len(s) + 1
+	<-s
+	if free > n {
+		return n
+	}
+	return free
+}
+
+// tryAcquire takes up to n free slots without blocking and returns how many it took
+func (s slots) tryAcquire(n int) int {
+	if s == nil {
+		return n
+	}
+	for taken := 0; taken < n; taken++ {
+		select {
+		case s <- struct{}{}:
+		default:
+			return taken
+		}
+	}
+	return n
+}
+
+// release frees n slots
+func (s slots) release(n int) {
+	if s == nil {
+		return
+	}
+	for i := 0; i < n; i++ {
+		<-s
+	}
+}
+
+// NewConsumer returns a Consumer that calls h with the messages it reserves from qName. Returns
+// nil and ErrTimeoutOutOfRange or ErrWaitOutOfRange if opts.Timeout or opts.Wait are out of range
+func NewConsumer(cl Client, token, projID, qName string, opts ConsumeOptions, h Handler) (*Consumer, error) {
+	if !timeoutInRange(opts.Timeout) {
+		return nil, ErrTimeoutOutOfRange
+	}
+	if !waitInRange(opts.Wait) {
+		return nil, ErrWaitOutOfRange
+	}
+	return &Consumer{cl: cl, token: token, projID: projID, qName: qName, opts: opts, h: h}, nil
+}
+
+// NewTypedConsumer is like NewConsumer, except that the Consumer JSON-decodes each message body
+// into a T and passes that to h, like ConsumeTyped does
+func NewTypedConsumer[T any](cl Client, token, projID, qName string, opts ConsumeOptions, h func(ctx context.Context, val T, ack *Ack) error) (*Consumer, error) {
+	return NewConsumer(cl, token, projID, qName, opts, typedHandler(opts, h))
+}
+
+// Consume repeatedly reserves messages from qName and calls h with each one, one at a time.
+// It blocks until ctx.Done() receives and then returns nil. Messages that were reserved but not
+// yet handled at that point are left to be redelivered after their reservations time out.
+//
+// Returns ErrTimeoutOutOfRange or ErrWaitOutOfRange immediately if opts.Timeout or opts.Wait are
+// out of range. Failed reserve requests are passed to opts.OnError and retried after a second.
+// Use NewConsumer instead to keep hold of the Consumer, for example to check its LastActivity
+func Consume(ctx context.Context, cl Client, token, projID, qName string, opts ConsumeOptions, h Handler) error {
+	c, err := NewConsumer(cl, token, projID, qName, opts, h)
+	if err != nil {
+		return err
+	}
+	return c.Run(ctx)
+}
+
+// ConsumeTyped is like Consume, except that it JSON-decodes each message body into a T and
+// passes that to h. Bodies that were encoded with a BodyCodec are decoded first. Messages whose
+// bodies can't be decoded are never passed to h, and are settled according to
+// opts.OnDecodeError instead
+func ConsumeTyped[T any](ctx context.Context, cl Client, token, projID, qName string, opts ConsumeOptions, h func(ctx context.Context, val T, ack *Ack) error) error {
+	c, err := NewTypedConsumer(cl, token, projID, qName, opts, h)
+	if err != nil {
+		return err
+	}
+	return c.Run(ctx)
+}
+
+// ConsumeRouted consumes from every queue in handlers at the same time, calling the handler that
+// a queue's name maps to with each message reserved from that queue, as if Consume was called
+// for each one with opts. Queues that aren't in handlers, or map to a nil handler, aren't
+// consumed from. opts.GlobalMaxInFlight bounds the number of messages held across all the
+// queues. It blocks until ctx.Done() receives and all the queues' consumers have returned, and
+// then returns nil.
+//
+// Returns ErrTimeoutOutOfRange or ErrWaitOutOfRange immediately, without consuming from any
+// queue, if opts.Timeout or opts.Wait are out of range, and ErrNoHandlers if handlers has no
+// non-nil handler
+func ConsumeRouted(ctx context.Context, cl Client, token, projID string, handlers map[string]Handler, opts ConsumeOptions) error {
+	var inFlight slots
+	if opts.GlobalMaxInFlight > 0 {
+		inFlight = make(slots, opts.GlobalMaxInFlight)
+	}
+	var consumers []*Consumer
+	for qName, h := range handlers {
+		if h == nil {
+			continue
+		}
+		c, err := NewConsumer(cl, token, projID, qName, opts, h)
+		if err != nil {
+			return err
+		}
+		c.inFlight = inFlight
+		consumers = append(consumers, c)
+	}
+	if len(consumers) == 0 {
+		return ErrNoHandlers
+	}
+	var wg sync.WaitGroup
+	for _, c := range consumers {
+		wg.Add(1)
+		go func(c *Consumer) {
+			defer wg.Done()
+			c.Run(ctx)
+		}(c)
+	}
+	wg.Wait()
+	return nil
+}
+
+func typedHandler[T any](opts ConsumeOptions, h func(context.Context, T, *Ack) error) Handler {
+	return func(ctx context.Context, msg DequeuedMessage, ack *Ack) error {
+		var val T
+		body, err := DecodeBody(msg, opts.Codecs...)
+		if err == nil {
+			err = json.Unmarshal([]byte(body), &val)
+		}
+		if err != nil {
+			var aErr error
+			switch opts.decodeAction(msg, err) {
+			case ActionRelease:
+				aErr = ack.Nack(ctx, 0)
+			case ActionDeadLetter:
+				aErr = ack.deadLetter(ctx, opts.DeadLetterQueue)
+			default:
+				aErr = ack.Ack(ctx)
+			}
+			if aErr != nil && aErr != ErrAlreadySettled {
+				// the message is only still unsettled if dead lettering failed. Returning the
+				// error makes the consumer release it, except in ManualAck mode. A failed
+				// release leaves it to be redelivered once its reservation times out
+				if opts.ManualAck {
+					ack.Nack(ctx, 0)
+				}
+				return aErr
+			}
+			return &DecodeError{MessageID: msg.ID, Err: err}
+		}
+		return h(ctx, val, ack)
+	}
+}
+
+// LastActivity returns the last time the consumer started running, completed a reserve request
+// or finished handling a message, regardless of whether the handler succeeded. Returns the zero
+// time if Run was never called.
+//
+// A consumer that's working normally is active at least every ConsumeOptions.Wait seconds, even
+// when the queue is empty, plus however long the handler takes for each message. If it hasn't
+// been active for much longer than that, it's likely wedged, for example in a stuck handler or a
+// reserve request that's not returning
+func (c *Consumer) LastActivity() time.Time {
+	nanos := atomic.LoadInt64(&c.lastActivity)
+	if nanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
+}
+
+func (c *Consumer) touchActivity() {
+	atomic.StoreInt64(&c.lastActivity, time.Now().UnixNano())
+}
+
+func (c *Consumer) onError(err error) {
+	if c.opts.OnError != nil {
+		c.opts.OnError(err)
+	}
+}
+
+// Run consumes messages like Consume does, until ctx.Done() receives, and then returns nil. Don't
+// call Run again before it returned
+func (c *Consumer) Run(ctx context.Context) error {
+	c.touchActivity()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		default:
+		}
+		msgs, err := c.reserve(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			c.onError(err)
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(consumeErrBackoff):
+			}
+			continue
+		}
+		c.touchActivity()
+		reservedAt := time.Now()
+		var touches []*autoTouch
+		expiries := make([]*time.Timer, len(msgs))
+		if c.opts.MaxMsgsPerSec > 0 {
+			touches = make([]*autoTouch, len(msgs))
+			for i, msg := range msgs {
+				// touching stops by itself when ctx is done
+				touches[i] = startAutoTouch(ctx, c.cl, c.token, c.projID, c.qName, msg, c.opts.Timeout, touchInterval(c.opts.Timeout), c.opts.TouchJitter, c.onError)
+			}
+		} else {
+			for i, msg := range msgs {
+				expiries[i] = c.watchExpiry(msg, reservedAt)
+			}
+		}
+		for i, msg := range msgs {
+			if touches != nil {
+				if !c.waitTurn(ctx) {
+					stopTimers(expiries)
+					return nil
+				}
+				msg = touches[i].stop()
+				expiries[i] = c.watchExpiry(msg, touches[i].lastTouched())
+			}
+			if ctx.Err() != nil {
+				stopTimers(expiries[i:])
+				return nil
+			}
+			c.handle(ctx, msg, reservedAt, expiries[i])
+			c.inFlight.release(1)
+			c.touchActivity()
+		}
+	}
+}
+
+// reserve reserves up to opts.Num messages and holds a slot of c.inFlight for each one it returns,
+// as described for ConsumeOptions.GlobalMaxInFlight. Returns no messages and a nil error if
+// ctx.Done() received while it was waiting for a free slot
+func (c *Consumer) reserve(ctx context.Context) ([]DequeuedMessage, error) {
+	wait := c.opts.Wait
+	if c.inFlight != nil {
+		wait = 0
+	}
+	num := c.inFlight.acquire(ctx, c.opts.num())
+	if num == 0 {
+		return nil, nil
+	}
+	msgs, err := c.cl.Dequeue(ctx, c.token, c.projID, c.qName, num, c.opts.Timeout, wait, false)
+	c.inFlight.release(num - len(msgs))
+	if c.inFlight == nil || c.opts.Wait == 0 || err != nil || len(msgs) > 0 {
+		return msgs, err
+	}
+	// the queue is empty, so wait for messages without holding any slots
+	num = c.inFlight.free(ctx, c.opts.num())
+	if num == 0 {
+		return nil, nil
+	}
+	msgs, err = c.cl.Dequeue(ctx, c.token, c.projID, c.qName, num, c.opts.Timeout, c.opts.Wait, false)
+	if err != nil {
+		return nil, err
+	}
+	taken := c.inFlight.tryAcquire(len(msgs))
+	for _, msg := range msgs[taken:] {
+		if _, err := c.cl.ReleaseReserved(ctx, c.token, c.projID, c.qName, msg.ID, msg.ReservationID, 0); err != nil {
+			c.onError(err)
+		}
+	}
+	return msgs[:taken], nil
+}
+
+// watchExpiry returns a timer that calls opts.OnReservationExpiring with msg once its reservation,
+// which was made or last extended at from, is about to expire. Returns nil if there's no
+// OnReservationExpiring
+func (c *Consumer) watchExpiry(msg DequeuedMessage, from time.Time) *time.Timer {
+	if c.opts.OnReservationExpiring == nil {
+		return nil
+	}
+	deadline := from.Add(time.Duration(int(c.opts.Timeout)) * time.Second)
+	return time.AfterFunc(time.Until(deadline.Add(-c.opts.expiringWithin())), func() {
+		c.opts.OnReservationExpiring(msg, time.Until(deadline))
+	})
+}
+
+// stopTimers stops all the non-nil timers in tmrs
+func stopTimers(tmrs []*time.Timer) {
+	for _, tmr := range tmrs {
+		if tmr != nil {
+			tmr.Stop()
+		}
+	}
+}
+
+// waitTurn blocks until the next message may be handled according to opts.MaxMsgsPerSec. Returns
+// false if ctx.Done() received first
+func (c *Consumer) waitTurn(ctx context.Context) bool {
+	now := time.Now()
+	if c.nextTurn.Before(now) {
+		c.nextTurn = now
+	}
+	if wait := c.nextTurn.Sub(now); wait > 0 {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(wait):
+		}
+	}
+	c.nextTurn = c.nextTurn.Add(time.Duration(float64(time.Second) / c.opts.MaxMsgsPerSec))
+	return true
+}
+
+// handle calls the handler with msg, which was reserved at reservedAt, and settles msg afterward
+// if the handler didn't. expiry, if non-nil, is stopped once msg is settled
+func (c *Consumer) handle(ctx context.Context, msg DequeuedMessage, reservedAt time.Time, expiry *time.Timer) {
+	ack := newAck(c.cl, c.token, c.projID, c.qName, msg, c.opts.Timeout, reservedAt, c.opts.metrics())
+	ack.expiry = expiry
+	ack.watch = c.watchExpiry
+	timedOut, hErr := c.callHandler(ctx, msg, ack)
+	if timedOut {
+		c.onError(&HandlerTimeoutError{MessageID: msg.ID, Timeout: c.opts.HandlerTimeout})
+		if err := ack.Nack(ctx, 0); err != nil && err != ErrAlreadySettled {
+			c.onError(err)
+		}
+		return
+	}
+	if hErr != nil {
+		c.onError(hErr)
+	}
+	if c.opts.ManualAck {
+		return
+	}
+	var err error
+	if hErr != nil {
+		err = ack.Nack(ctx, 0)
+	} else {
+		err = ack.Ack(ctx)
+	}
+	if err != nil && err != ErrAlreadySettled {
+		c.onError(err)
+	}
+}
+
+// callHandler calls the handler with msg and returns false and its error. If the handler doesn't
+// return within the handler timeout, returns true without waiting for it any longer. When ctx is done,
+// waits for the handler to return no matter how long it takes, so shutting down doesn't count
+// as a timeout
+func (c *Consumer) callHandler(ctx context.Context, msg DequeuedMessage, ack *Ack) (bool, error) {
+	if c.opts.HandlerTimeout <= 0 {
+		return false, c.h(ctx, msg, ack)
+	}
+	hCtx, cancel := context.WithTimeout(ctx, c.opts.HandlerTimeout)
+	defer cancel()
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- c.h(hCtx, msg, ack)
+	}()
+	select {
+	case err := <-errCh:
+		return false, err
+	case <-hCtx.Done():
+	}
+	select {
+	case err := <-errCh:
+		return false, err
+	default:
+	}
+	if ctx.Err() != nil {
+		return false, <-errCh
+	}
+	return true, nil
+}
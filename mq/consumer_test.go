@@ -0,0 +1,636 @@
+package mq
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+	"golang.org/x/net/context"
+)
+
+type testJob struct {
+	Num int `json:"num"`
+}
+
+var consumeOpts = ConsumeOptions{Num: 10, Timeout: Timeout(30), Wait: Wait(1)}
+
+// runConsumer calls consume in a goroutine and returns a func that stops it and waits for it
+// to return its error
+func runConsumer(consume func(context.Context) error) func() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- consume(ctx)
+	}()
+	return func() error {
+		cancel()
+		return <-errCh
+	}
+}
+
+func enqueueBodies(t *testing.T, cl Client, bodies ...string) {
+	var msgs []NewMessage
+	for _, body := range bodies {
+		msgs = append(msgs, NewMessage{Body: body, PushHeaders: make(map[string]string)})
+	}
+	_, err := cl.Enqueue(bgCtx, token, projID, qName, msgs)
+	assert.NoErr(t, err)
+}
+
+func queueSize(t *testing.T, cl Client) int {
+	info, err := cl.GetQueueInfo(bgCtx, token, projID, qName)
+	assert.NoErr(t, err)
+	return info.Size
+}
+
+func TestConsumeTyped(t *testing.T) {
+	cl := NewMemClient()
+	for i := 0; i < 3; i++ {
+		b, err := json.Marshal(testJob{Num: i})
+		assert.NoErr(t, err)
+		enqueueBodies(t, cl, string(b))
+	}
+	jobs := make(chan testJob)
+	stop := runConsumer(func(ctx context.Context) error {
+		return ConsumeTyped(ctx, cl, token, projID, qName, consumeOpts, func(ctx context.Context, job testJob, ack *Ack) error {
+			jobs <- job
+			return nil
+		})
+	})
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, <-jobs, testJob{Num: i}, "consumed job")
+	}
+	assert.NoErr(t, stop())
+	assert.Equal(t, queueSize(t, cl), 0, "queue size")
+}
+
+// consumeUndecodable runs a typed consumer with opts until it reports an error for the
+// undecodable message at the front of the queue, and returns that error
+func consumeUndecodable(t *testing.T, cl Client, opts ConsumeOptions) error {
+	errCh := make(chan error, 1)
+	opts.OnError = func(err error) {
+		select {
+		case errCh <- err:
+		default:
+		}
+	}
+	stop := runConsumer(func(ctx context.Context) error {
+		return ConsumeTyped(ctx, cl, token, projID, qName, opts, func(ctx context.Context, job testJob, ack *Ack) error {
+			t.Errorf("handler called with undecodable message")
+			return nil
+		})
+	})
+	err := <-errCh
+	assert.NoErr(t, stop())
+	return err
+}
+
+func TestConsumeTypedDecodeError(t *testing.T) {
+	cl := NewMemClient()
+	enqueueBodies(t, cl, "not json")
+	err := consumeUndecodable(t, cl, consumeOpts)
+	_, ok := err.(*DecodeError)
+	assert.True(t, ok, "reported error wasn't a *DecodeError")
+	assert.Equal(t, queueSize(t, cl), 0, "queue size")
+}
+
+func TestConsumeTypedDecodeErrorDeadLetter(t *testing.T) {
+	const dlq = "test-dlq"
+	cl := NewMemClient()
+	enqueueBodies(t, cl, "not json")
+	opts := consumeOpts
+	opts.DeadLetterQueue = dlq
+	_, ok := consumeUndecodable(t, cl, opts).(*DecodeError)
+	assert.True(t, ok, "reported error wasn't a *DecodeError")
+	assert.Equal(t, queueSize(t, cl), 0, "queue size")
+	msgs, err := cl.Peek(bgCtx, token, projID, dlq, MaxPeek)
+	assert.NoErr(t, err)
+	assert.Equal(t, len(msgs), 1, "number of dead lettered messages")
+	assert.Equal(t, msgs[0].Body, "not json", "dead lettered message body")
+
+	enqueueBodies(t, cl, "not json")
+	opts.DeadLetterQueue = ""
+	opts.OnDecodeError = func(DequeuedMessage, error) Action { return ActionDeadLetter }
+	assert.Err(t, ErrNoDeadLetterQueue, consumeUndecodable(t, cl, opts))
+}
+
+func TestConsumeTypedDecodeErrorManualAck(t *testing.T) {
+	cl := NewMemClient()
+	enqueueBodies(t, cl, "not json")
+	counts := make(chan int, 10)
+	opts := consumeOpts
+	opts.ManualAck = true
+	opts.OnDecodeError = func(raw DequeuedMessage, err error) Action {
+		counts <- raw.ReservedCount
+		if raw.ReservedCount == 1 {
+			// fails, since there's no dead letter queue
+			return ActionDeadLetter
+		}
+		return ActionDelete
+	}
+	stop := runConsumer(func(ctx context.Context) error {
+		return ConsumeTyped(ctx, cl, token, projID, qName, opts, func(ctx context.Context, job testJob, ack *Ack) error {
+			t.Errorf("handler called with undecodable message")
+			return nil
+		})
+	})
+	assert.Equal(t, <-counts, 1, "reserved count on first delivery")
+	// the failed dead lettering released the message rather than leaving it reserved
+	select {
+	case count := <-counts:
+		assert.Equal(t, count, 2, "reserved count on redelivery")
+	case <-time.After(time.Duration(int(opts.Wait)) * time.Second * 2):
+		t.Fatalf("message wasn't redelivered")
+	}
+	assert.NoErr(t, stop())
+	assert.Equal(t, queueSize(t, cl), 0, "queue size")
+}
+
+func TestConsumeTypedDecodeErrorRelease(t *testing.T) {
+	cl := NewMemClient()
+	enqueueBodies(t, cl, "not json")
+	counts := make(chan int, 10)
+	opts := consumeOpts
+	opts.OnDecodeError = func(raw DequeuedMessage, err error) Action {
+		counts <- raw.ReservedCount
+		if raw.ReservedCount == 1 {
+			return ActionRelease
+		}
+		return ActionDelete
+	}
+	stop := runConsumer(func(ctx context.Context) error {
+		return ConsumeTyped(ctx, cl, token, projID, qName, opts, func(ctx context.Context, job testJob, ack *Ack) error {
+			t.Errorf("handler called with undecodable message")
+			return nil
+		})
+	})
+	assert.Equal(t, <-counts, 1, "reserved count on first delivery")
+	assert.Equal(t, <-counts, 2, "reserved count on redelivery")
+	assert.NoErr(t, stop())
+	assert.Equal(t, queueSize(t, cl), 0, "queue size")
+}
+
+func TestConsumeRouted(t *testing.T) {
+	cl := NewMemClient()
+	const otherQName = "other-queue"
+	enqueueBodies(t, cl, "abc")
+	_, err := cl.Enqueue(bgCtx, token, projID, otherQName, []NewMessage{{Body: "def", PushHeaders: make(map[string]string)}})
+	assert.NoErr(t, err)
+	routed := make(chan string, 2)
+	route := func(qName string) Handler {
+		return func(ctx context.Context, msg DequeuedMessage, ack *Ack) error {
+			routed <- qName + ":" + msg.Body
+			return nil
+		}
+	}
+	handlers := map[string]Handler{qName: route(qName), otherQName: route(otherQName)}
+	stop := runConsumer(func(ctx context.Context) error {
+		return ConsumeRouted(ctx, cl, token, projID, handlers, consumeOpts)
+	})
+	got := map[string]bool{<-routed: true, <-routed: true}
+	assert.NoErr(t, stop())
+	assert.True(t, got[qName+":abc"], "message from [%s] wasn't routed to its handler", qName)
+	assert.True(t, got[otherQName+":def"], "message from [%s] wasn't routed to its handler", otherQName)
+	assert.Err(t, ErrTimeoutOutOfRange, ConsumeRouted(bgCtx, cl, token, projID, handlers, ConsumeOptions{Wait: Wait(1)}))
+}
+
+// fixedClient is a Client whose Dequeue always returns msg. Unlike MemClient, it doesn't
+// synchronize its callers, so it doesn't hide data races between consumers from the race
+// detector
+type fixedClient struct {
+	NoopClient
+	msg DequeuedMessage
+}
+
+func (f *fixedClient) Dequeue(ctx context.Context, token, projID, qName string, num int, timeout Timeout, wait Wait, delete bool) ([]DequeuedMessage, error) {
+	return []DequeuedMessage{f.msg}, nil
+}
+
+func TestConsumeRoutedTypedSharedCodecs(t *testing.T) {
+	enc, err := encodeBody(NewMessage{Body: `{"num":1}`, PushHeaders: make(map[string]string)}, GzipCodec{})
+	assert.NoErr(t, err)
+	cl := &fixedClient{msg: DequeuedMessage{ID: 1, Body: enc.Body, PushHeaders: enc.PushHeaders}}
+	opts := consumeOpts
+	// spare capacity, so that appending to it would write to the same array from both queues
+	opts.Codecs = make([]BodyCodec, 1, 4)
+	opts.Codecs[0] = reverseCodec{}
+	// a channel for each queue, so that the handlers don't synchronize with each other either
+	jobs := []chan testJob{make(chan testJob, 10), make(chan testJob, 10)}
+	handler := func(jobs chan testJob) Handler {
+		return typedHandler(opts, func(ctx context.Context, job testJob, ack *Ack) error {
+			select {
+			case jobs <- job:
+			default:
+			}
+			return nil
+		})
+	}
+	stop := runConsumer(func(ctx context.Context) error {
+		return ConsumeRouted(ctx, cl, token, projID, map[string]Handler{qName: handler(jobs[0]), "other-queue": handler(jobs[1])}, opts)
+	})
+	for _, ch := range jobs {
+		assert.Equal(t, <-ch, testJob{Num: 1}, "decoded job")
+	}
+	assert.NoErr(t, stop())
+}
+
+func TestConsumeRoutedNoHandlers(t *testing.T) {
+	cl := NewMemClient()
+	assert.Err(t, ErrNoHandlers, ConsumeRouted(bgCtx, cl, token, projID, nil, consumeOpts))
+	assert.Err(t, ErrNoHandlers, ConsumeRouted(bgCtx, cl, token, projID, map[string]Handler{qName: nil}, consumeOpts))
+}
+
+func TestConsumeRoutedGlobalMaxInFlight(t *testing.T) {
+	cl := NewMemClient()
+	const otherQName = "other-queue"
+	enqueueBodies(t, cl, "a", "b", "c", "d")
+	_, err := cl.Enqueue(bgCtx, token, projID, otherQName, []NewMessage{
+		{Body: "e", PushHeaders: make(map[string]string)},
+		{Body: "f", PushHeaders: make(map[string]string)},
+	})
+	assert.NoErr(t, err)
+	reserved := make(chan int, 6)
+	h := func(ctx context.Context, msg DequeuedMessage, ack *Ack) error {
+		cl.lck.Lock()
+		reserved <- len(cl.reserved)
+		cl.lck.Unlock()
+		// give the other queue's consumer a chance to reserve more than it may
+		time.Sleep(10 * time.Millisecond)
+		return nil
+	}
+	opts := consumeOpts
+	opts.GlobalMaxInFlight = 2
+	stop := runConsumer(func(ctx context.Context) error {
+		return ConsumeRouted(ctx, cl, token, projID, map[string]Handler{qName: h, otherQName: h}, opts)
+	})
+	for i := 0; i < 6; i++ {
+		num := <-reserved
+		assert.True(t, num <= 2, "[%d] messages were reserved at once", num)
+	}
+	assert.NoErr(t, stop())
+}
+
+func TestConsumeRoutedGlobalMaxInFlightIdleQueue(t *testing.T) {
+	cl := NewMemClient()
+	enqueueBodies(t, cl, "a", "b", "c")
+	handled := make(chan string, 3)
+	busy := func(ctx context.Context, msg DequeuedMessage, ack *Ack) error {
+		handled <- msg.Body
+		return nil
+	}
+	idle := func(ctx context.Context, msg DequeuedMessage, ack *Ack) error {
+		t.Errorf("handled message [%d] from the empty queue", msg.ID)
+		return nil
+	}
+	opts := consumeOpts
+	opts.Num = 1
+	opts.GlobalMaxInFlight = 1
+	stop := runConsumer(func(ctx context.Context) error {
+		return ConsumeRouted(ctx, cl, token, projID, map[string]Handler{qName: busy, "empty-queue": idle}, opts)
+	})
+	// waiting on the empty queue mustn't hold the only slot for the busy queue
+	timeout := time.After(time.Duration(int(opts.Wait)) * time.Second / 2)
+	for i := 0; i < 3; i++ {
+		select {
+		case <-handled:
+		case <-timeout:
+			t.Fatalf("only [%d] messages were handled from the busy queue", i)
+		}
+	}
+	assert.NoErr(t, stop())
+}
+
+func TestConsumeNack(t *testing.T) {
+	cl := NewMemClient()
+	enqueueBodies(t, cl, "abc")
+	counts := make(chan int)
+	errCh := make(chan error, 10)
+	opts := consumeOpts
+	opts.OnError = func(err error) { errCh <- err }
+	handlerErr := errors.New("handler failed")
+	stop := runConsumer(func(ctx context.Context) error {
+		return Consume(ctx, cl, token, projID, qName, opts, func(ctx context.Context, msg DequeuedMessage, ack *Ack) error {
+			counts <- msg.ReservedCount
+			if msg.ReservedCount == 1 {
+				return handlerErr
+			}
+			return nil
+		})
+	})
+	assert.Equal(t, <-counts, 1, "reserved count on first delivery")
+	assert.Equal(t, <-counts, 2, "reserved count on redelivery")
+	assert.NoErr(t, stop())
+	assert.Err(t, handlerErr, <-errCh)
+	assert.Equal(t, queueSize(t, cl), 0, "queue size")
+}
+
+func TestConsumeExplicitAck(t *testing.T) {
+	cl := NewMemClient()
+	enqueueBodies(t, cl, "abc")
+	acked := make(chan error)
+	stop := runConsumer(func(ctx context.Context) error {
+		return Consume(ctx, cl, token, projID, qName, consumeOpts, func(ctx context.Context, msg DequeuedMessage, ack *Ack) error {
+			assert.NoErr(t, ack.Ack(ctx))
+			acked <- ack.Nack(ctx, 0)
+			return errors.New("ignored, since the message was already acked")
+		})
+	})
+	assert.Err(t, ErrAlreadySettled, <-acked)
+	assert.NoErr(t, stop())
+	assert.Equal(t, queueSize(t, cl), 0, "queue size")
+}
+
+func TestAckNackDelay(t *testing.T) {
+	cl := NewMemClient()
+	enqueueBodies(t, cl, "abc")
+	msgs, err := cl.Dequeue(bgCtx, token, projID, qName, 1, Timeout(30), Wait(0), false)
+	assert.NoErr(t, err)
+	assert.Equal(t, len(msgs), 1, "number of dequeued messages")
+	ack := newAck(cl, token, projID, qName, msgs[0], Timeout(30), time.Now(), NopMetrics{})
+	assert.Err(t, ErrDelayOutOfRange, ack.Nack(bgCtx, MaxDelay+1))
+	assert.NoErr(t, ack.Nack(bgCtx, 60))
+	assert.Err(t, ErrAlreadySettled, ack.Nack(bgCtx, 0))
+	peeked, err := cl.Peek(bgCtx, token, projID, qName, MaxPeek)
+	assert.NoErr(t, err)
+	assert.Equal(t, len(peeked), 0, "number of available messages while the nack delay is pending")
+}
+
+func TestAckTouch(t *testing.T) {
+	cl := NewMemClient()
+	enqueueBodies(t, cl, "abc")
+	expiring := make(chan DequeuedMessage, 2)
+	errCh := make(chan error, 10)
+	opts := consumeOpts
+	// fires after about 100ms
+	opts.ReservationExpiringWithin = time.Duration(int(opts.Timeout))*time.Second - 100*time.Millisecond
+	opts.OnReservationExpiring = func(m DequeuedMessage, rem time.Duration) { expiring <- m }
+	opts.OnError = func(err error) { errCh <- err }
+	touched := make(chan string, 1)
+	handled := make(chan struct{})
+	stop := runConsumer(func(ctx context.Context) error {
+		return Consume(ctx, cl, token, projID, qName, opts, func(ctx context.Context, msg DequeuedMessage, ack *Ack) error {
+			defer close(handled)
+			<-expiring
+			if err := ack.Touch(ctx); err != nil {
+				return err
+			}
+			touched <- ack.Message().ReservationID
+			// the touched reservation is reported once it's about to expire too
+			<-expiring
+			return nil
+		})
+	})
+	<-handled
+	newResID := <-touched
+	assert.NoErr(t, stop())
+	select {
+	case err := <-errCh:
+		t.Fatalf("consumer error after touching [%s]", err)
+	default:
+	}
+	assert.True(t, newResID != "", "touched reservation ID was empty")
+	assert.Equal(t, queueSize(t, cl), 0, "queue size after acking the touched message")
+}
+
+func TestConsumeOnReservationExpiring(t *testing.T) {
+	cl := NewMemClient()
+	enqueueBodies(t, cl, "slow", "fast")
+	expiring := make(chan string, 2)
+	remaining := make(chan time.Duration, 2)
+	opts := consumeOpts
+	// fires after about 100ms
+	opts.ReservationExpiringWithin = time.Duration(int(opts.Timeout))*time.Second - 100*time.Millisecond
+	opts.OnReservationExpiring = func(m DequeuedMessage, rem time.Duration) {
+		expiring <- m.Body
+		remaining <- rem
+	}
+	handled := make(chan struct{})
+	stop := runConsumer(func(ctx context.Context) error {
+		return Consume(ctx, cl, token, projID, qName, opts, func(ctx context.Context, msg DequeuedMessage, ack *Ack) error {
+			if msg.Body == "slow" {
+				time.Sleep(300 * time.Millisecond)
+			}
+			if msg.Body == "fast" {
+				close(handled)
+			}
+			return nil
+		})
+	})
+	<-handled
+	// the fast message waited behind the slow one, so it's expiring too
+	got := map[string]bool{<-expiring: true, <-expiring: true}
+	assert.True(t, got["slow"] && got["fast"], "expiring messages [%v]", got)
+	rem := <-remaining
+	assert.True(t, rem > 0 && rem <= opts.ReservationExpiringWithin, "remaining reservation time [%s]", rem)
+	assert.NoErr(t, stop())
+
+	// handled messages aren't reported
+	enqueueBodies(t, cl, "quick")
+	stop = runConsumer(func(ctx context.Context) error {
+		return Consume(ctx, cl, token, projID, qName, opts, func(ctx context.Context, msg DequeuedMessage, ack *Ack) error {
+			return nil
+		})
+	})
+	time.Sleep(300 * time.Millisecond)
+	assert.NoErr(t, stop())
+	select {
+	case body := <-expiring:
+		t.Fatalf("message [%s] was reported as expiring after it was acked", body)
+	default:
+	}
+}
+
+func TestConsumeInvalidOptions(t *testing.T) {
+	cl := NewMemClient()
+	h := func(context.Context, DequeuedMessage, *Ack) error { return nil }
+	assert.Err(t, ErrTimeoutOutOfRange, Consume(bgCtx, cl, token, projID, qName, ConsumeOptions{Wait: Wait(1)}, h))
+	assert.Err(t, ErrWaitOutOfRange, Consume(bgCtx, cl, token, projID, qName, ConsumeOptions{Timeout: Timeout(30), Wait: Wait(31)}, h))
+}
+
+func TestMemReleaseReserved(t *testing.T) {
+	cl := NewMemClient()
+	enqueueBodies(t, cl, "abc")
+	msgs, err := cl.Dequeue(bgCtx, token, projID, qName, 1, Timeout(30), Wait(0), false)
+	assert.NoErr(t, err)
+	assert.Equal(t, len(msgs), 1, "number of dequeued messages")
+	_, err = cl.ReleaseReserved(bgCtx, token, projID, qName, msgs[0].ID, msgs[0].ReservationID, MaxDelay+1)
+	assert.Err(t, ErrDelayOutOfRange, err)
+	_, err = cl.ReleaseReserved(bgCtx, token, projID, qName, msgs[0].ID, msgs[0].ReservationID, 0)
+	assert.NoErr(t, err)
+	_, err = cl.ReleaseReserved(bgCtx, token, projID, qName, msgs[0].ID, msgs[0].ReservationID, 0)
+	assert.Err(t, ErrNoSuchReservation, err)
+	msgs, err = cl.Dequeue(bgCtx, token, projID, qName, 1, Timeout(30), Wait(0), false)
+	assert.NoErr(t, err)
+	assert.Equal(t, len(msgs), 1, "number of dequeued messages")
+	assert.Equal(t, msgs[0].ReservedCount, 2, "reserved count")
+}
+
+func TestConsumeWaitsForMessages(t *testing.T) {
+	cl := NewMemClient()
+	got := make(chan string)
+	stop := runConsumer(func(ctx context.Context) error {
+		return Consume(ctx, cl, token, projID, qName, consumeOpts, func(ctx context.Context, msg DequeuedMessage, ack *Ack) error {
+			got <- msg.Body
+			return nil
+		})
+	})
+	time.Sleep(50 * time.Millisecond)
+	enqueueBodies(t, cl, "late")
+	assert.Equal(t, <-got, "late", "message body")
+	assert.NoErr(t, stop())
+}
+
+func TestConsumeHandlerTimeout(t *testing.T) {
+	cl := NewMemClient()
+	enqueueBodies(t, cl, "stuck", "ok")
+	errCh := make(chan error, 10)
+	got := make(chan string, 10)
+	block := make(chan struct{})
+	defer close(block)
+	opts := consumeOpts
+	opts.HandlerTimeout = 20 * time.Millisecond
+	opts.OnError = func(err error) { errCh <- err }
+	stop := runConsumer(func(ctx context.Context) error {
+		return Consume(ctx, cl, token, projID, qName, opts, func(ctx context.Context, msg DequeuedMessage, ack *Ack) error {
+			got <- msg.Body
+			if msg.Body == "stuck" && msg.ReservedCount == 1 {
+				// ignore ctx, like a badly behaved handler
+				<-block
+			}
+			return nil
+		})
+	})
+	assert.Equal(t, <-got, "stuck", "first handled message")
+	timeoutErr, ok := (<-errCh).(*HandlerTimeoutError)
+	assert.True(t, ok, "the consumer didn't report a *HandlerTimeoutError")
+	assert.Equal(t, timeoutErr.Timeout, opts.HandlerTimeout, "reported timeout")
+	assert.Equal(t, <-got, "ok", "second handled message")
+	// the stuck message was released, so it's redelivered
+	assert.Equal(t, <-got, "stuck", "third handled message")
+	assert.NoErr(t, stop())
+	assert.Equal(t, queueSize(t, cl), 0, "queue size")
+}
+
+func TestConsumeHandlerTimeoutCancelsContext(t *testing.T) {
+	cl := NewMemClient()
+	enqueueBodies(t, cl, "abc")
+	ctxErrs := make(chan error, 1)
+	opts := consumeOpts
+	opts.HandlerTimeout = 20 * time.Millisecond
+	stop := runConsumer(func(ctx context.Context) error {
+		return Consume(ctx, cl, token, projID, qName, opts, func(ctx context.Context, msg DequeuedMessage, ack *Ack) error {
+			<-ctx.Done()
+			select {
+			case ctxErrs <- ctx.Err():
+			default:
+			}
+			return ctx.Err()
+		})
+	})
+	assert.Err(t, context.DeadlineExceeded, <-ctxErrs)
+	assert.NoErr(t, stop())
+}
+
+func TestConsumeManualAck(t *testing.T) {
+	cl := NewMemClient()
+	enqueueBodies(t, cl, "abc", "def")
+	acks := make(chan *Ack, 2)
+	opts := consumeOpts
+	opts.ManualAck = true
+	stop := runConsumer(func(ctx context.Context) error {
+		return Consume(ctx, cl, token, projID, qName, opts, func(ctx context.Context, msg DequeuedMessage, ack *Ack) error {
+			acks <- ack
+			if msg.Body == "def" {
+				return errors.New("not nacked in manual mode")
+			}
+			return nil
+		})
+	})
+	first, second := <-acks, <-acks
+	assert.NoErr(t, stop())
+	// neither was settled by the consumer, so both are still reserved
+	assert.Equal(t, queueSize(t, cl), 2, "queue size")
+	assert.Equal(t, first.Message().Body, "abc", "first message body")
+	assert.NoErr(t, first.Ack(bgCtx))
+	assert.NoErr(t, second.Nack(bgCtx, 0))
+	assert.Equal(t, queueSize(t, cl), 1, "queue size")
+	msgs, err := cl.Dequeue(bgCtx, token, projID, qName, 1, Timeout(30), Wait(0), false)
+	assert.NoErr(t, err)
+	assert.Equal(t, len(msgs), 1, "number of dequeued messages")
+	assert.Equal(t, msgs[0].Body, "def", "released message body")
+}
+
+type processedMetrics struct {
+	NopMetrics
+	durs chan time.Duration
+}
+
+func (p processedMetrics) ObserveProcessed(qName string, dur time.Duration) {
+	p.durs <- dur
+}
+
+func TestConsumeProcessingMetrics(t *testing.T) {
+	cl := NewMemClient()
+	enqueueBodies(t, cl, "abc")
+	metrics := processedMetrics{durs: make(chan time.Duration, 1)}
+	opts := consumeOpts
+	opts.Metrics = metrics
+	stop := runConsumer(func(ctx context.Context) error {
+		return Consume(ctx, cl, token, projID, qName, opts, func(ctx context.Context, msg DequeuedMessage, ack *Ack) error {
+			time.Sleep(20 * time.Millisecond)
+			return nil
+		})
+	})
+	assert.True(t, <-metrics.durs >= 20*time.Millisecond, "processing time was shorter than the handler")
+	assert.NoErr(t, stop())
+}
+
+func TestConsumerLastActivity(t *testing.T) {
+	cl := NewMemClient()
+	block := make(chan struct{})
+	handling := make(chan struct{})
+	c, err := NewConsumer(cl, token, projID, qName, consumeOpts, func(ctx context.Context, msg DequeuedMessage, ack *Ack) error {
+		close(handling)
+		<-block
+		return nil
+	})
+	assert.NoErr(t, err)
+	assert.True(t, c.LastActivity().IsZero(), "consumer was active before running")
+	enqueueBodies(t, cl, "abc")
+	start := time.Now()
+	stop := runConsumer(c.Run)
+	<-handling
+	stuck := c.LastActivity()
+	assert.False(t, stuck.Before(start), "consumer wasn't active after starting")
+	time.Sleep(20 * time.Millisecond)
+	// the handler is stuck, so there's no activity
+	assert.Equal(t, c.LastActivity(), stuck, "last activity while the handler is stuck")
+	close(block)
+	assert.NoErr(t, stop())
+	assert.True(t, c.LastActivity().After(stuck), "consumer wasn't active after the handler returned")
+}
+
+func TestConsumeMaxMsgsPerSec(t *testing.T) {
+	cl := NewMemClient()
+	enqueueBodies(t, cl, "a", "b", "c", "d")
+	handled := make(chan time.Time, 4)
+	opts := consumeOpts
+	opts.MaxMsgsPerSec = 20
+	stop := runConsumer(func(ctx context.Context) error {
+		return Consume(ctx, cl, token, projID, qName, opts, func(ctx context.Context, msg DequeuedMessage, ack *Ack) error {
+			handled <- time.Now()
+			return nil
+		})
+	})
+	first := <-handled
+	var last time.Time
+	for i := 0; i < 3; i++ {
+		last = <-handled
+	}
+	assert.NoErr(t, stop())
+	// 4 messages at 20 per second take at least 3 intervals of 50ms
+	assert.True(t, last.Sub(first) >= 150*time.Millisecond, "4 messages were handled within [%s]", last.Sub(first))
+	assert.Equal(t, queueSize(t, cl), 0, "queue size")
+}
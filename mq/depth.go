@@ -0,0 +1,130 @@
+package mq
+
+import (
+	"errors"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+var (
+	// ErrInvalidInterval is returned from funcs that poll on an interval when the interval isn't positive
+	ErrInvalidInterval = errors.New("interval must be positive")
+)
+
+// DepthDirection is the direction in which a queue's depth crossed from empty to non-empty or vice versa
+type DepthDirection int
+
+const (
+	// DepthFilled indicates that a queue went from empty to having messages
+	DepthFilled DepthDirection = iota
+	// DepthEmptied indicates that a queue went from having messages to empty
+	DepthEmptied
+)
+
+// String converts a DepthDirection to a printable string
+func (d DepthDirection) String() string {
+	switch d {
+	case DepthFilled:
+		return "filled"
+	case DepthEmptied:
+		return "emptied"
+	default:
+		return "unknown"
+	}
+}
+
+// DepthEvent is sent on the channel that WatchDepth returns each time the watched queue
+// goes from empty to non-empty or vice versa
+type DepthEvent struct {
+	// Size is the size of the queue when the change was observed
+	Size int
+	// Direction is the direction of the change
+	Direction DepthDirection
+}
+
+// WatchDepth polls the size of qName every interval and returns a channel that receives a
+// DepthEvent each time the queue goes from empty to having messages, or from having messages
+// to empty. The queue is assumed to start out empty, so if it has messages when WatchDepth
+// is called, the first event is a DepthFilled.
+//
+// WatchDepth gets the size of the queue once before returning, and returns a nil channel and the
+// error if that fails. Errors from later polls are ignored and the next poll proceeds as normal.
+// Returns ErrInvalidInterval if interval isn't positive. The returned channel is closed after
+// ctx.Done() receives.
+//
+// Note that changes that happen and revert between polls won't produce events
+func WatchDepth(ctx context.Context, cl Client, token, projID, qName string, interval time.Duration) (<-chan DepthEvent, error) {
+	if interval <= 0 {
+		return nil, ErrInvalidInterval
+	}
+	info, err := cl.GetQueueInfo(ctx, token, projID, qName)
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan DepthEvent)
+	go func() {
+		defer close(ch)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		empty := true
+		size := info.Size
+		for {
+			if (size == 0) != empty {
+				empty = size == 0
+				evt := DepthEvent{Size: size, Direction: DepthFilled}
+				if empty {
+					evt.Direction = DepthEmptied
+				}
+				select {
+				case ch <- evt:
+				case <-ctx.Done():
+					return
+				}
+			}
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+			info, err := cl.GetQueueInfo(ctx, token, projID, qName)
+			if err != nil {
+				continue
+			}
+			size = info.Size
+		}
+	}()
+	return ch, nil
+}
+
+// GrowthRate samples the size of qName, waits for window and samples it again, and returns the
+// net change in size per second between the two samples. A positive rate means the queue is
+// growing and a negative one means it's shrinking. Returns ErrInvalidInterval if window isn't
+// positive, ctx.Err() if ctx.Done() receives before the window elapses, or the error from
+// either sample.
+//
+// Only the two samples are compared, so the rate says nothing about what happened in between,
+// and messages enqueued and consumed within the window cancel each other out. The rate is
+// computed over the time between the samples as seen by the caller, which includes the latency
+// of the requests, so windows that aren't much longer than that latency give noisy results
+func GrowthRate(ctx context.Context, cl Client, token, projID, qName string, window time.Duration) (float64, error) {
+	if window <= 0 {
+		return 0, ErrInvalidInterval
+	}
+	first, err := cl.GetQueueInfo(ctx, token, projID, qName)
+	if err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	select {
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	case <-time.After(window):
+	}
+	second, err := cl.GetQueueInfo(ctx, token, projID, qName)
+	if err != nil {
+		return 0, err
+	}
+	return float64(second.Size-first.Size) / time.Since(start).Seconds(), nil
+}
@@ -0,0 +1,79 @@
+package mq
+
+import (
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+	"golang.org/x/net/context"
+)
+
+func recvDepthEvent(t *testing.T, ch <-chan DepthEvent) DepthEvent {
+	select {
+	case evt, ok := <-ch:
+		assert.True(t, ok, "depth event channel was closed")
+		return evt
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no depth event received")
+		return DepthEvent{}
+	}
+}
+
+func TestWatchDepth(t *testing.T) {
+	cl := NewMemClient()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, err := cl.Enqueue(ctx, token, projID, qName, []NewMessage{{Body: "abc", PushHeaders: make(map[string]string)}})
+	assert.NoErr(t, err)
+	ch, err := WatchDepth(ctx, cl, token, projID, qName, 10*time.Millisecond)
+	assert.NoErr(t, err)
+	assert.Equal(t, recvDepthEvent(t, ch), DepthEvent{Size: 1, Direction: DepthFilled}, "first depth event")
+
+	msgs, err := cl.Dequeue(ctx, token, projID, qName, 1, Timeout(30), Wait(1), false)
+	assert.NoErr(t, err)
+	assert.Equal(t, len(msgs), 1, "number of dequeued messages")
+	_, err = cl.DeleteReserved(ctx, token, projID, qName, msgs[0].ID, msgs[0].ReservationID)
+	assert.NoErr(t, err)
+	assert.Equal(t, recvDepthEvent(t, ch), DepthEvent{Size: 0, Direction: DepthEmptied}, "second depth event")
+
+	cancel()
+	for range ch {
+	}
+}
+
+func TestWatchDepthErrors(t *testing.T) {
+	cl := NewMemClient()
+	_, err := WatchDepth(bgCtx, cl, token, projID, qName, 0)
+	assert.Err(t, ErrInvalidInterval, err)
+	_, err = WatchDepth(bgCtx, cl, token, projID, qName, time.Second)
+	assert.Err(t, ErrNoSuchQueue, err)
+}
+
+func TestGrowthRate(t *testing.T) {
+	cl := NewMemClient()
+	enqueueBodies(t, cl, "abc")
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cl.Enqueue(bgCtx, token, projID, qName, []NewMessage{
+			{Body: "def", PushHeaders: make(map[string]string)},
+			{Body: "ghi", PushHeaders: make(map[string]string)},
+		})
+	}()
+	rate, err := GrowthRate(bgCtx, cl, token, projID, qName, 100*time.Millisecond)
+	assert.NoErr(t, err)
+	// 2 messages in a little more than 100ms
+	assert.True(t, rate > 10 && rate <= 20, "growth rate [%f] was not in (10, 20]", rate)
+}
+
+func TestGrowthRateErrors(t *testing.T) {
+	cl := NewMemClient()
+	_, err := GrowthRate(bgCtx, cl, token, projID, qName, 0)
+	assert.Err(t, ErrInvalidInterval, err)
+	_, err = GrowthRate(bgCtx, cl, token, projID, qName, time.Millisecond)
+	assert.Err(t, ErrNoSuchQueue, err)
+	enqueueBodies(t, cl, "abc")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = GrowthRate(ctx, cl, token, projID, qName, time.Minute)
+	assert.Err(t, context.DeadlineExceeded, err)
+}
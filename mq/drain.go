@@ -0,0 +1,97 @@
+package mq
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// drainReleaseTimeout is how long Drain spends releasing the messages it still holds after it
+// was stopped, which is usually because its context is done, and deleting each handled message
+const drainReleaseTimeout = 10 * time.Second
+
+// Drained is the result of Drain
+type Drained struct {
+	// Processed are the IDs of the messages that were handled and deleted, in order
+	Processed []int
+	// Released are the IDs of the messages that were reserved but released back onto the queue
+	// without being passed to h, because Drain stopped before it got to them
+	Released []int
+	// Failed is the ID of the message that h returned an error for, if it did. The message is
+	// released back onto the queue too, unless releasing it fails, in which case it's
+	// redelivered once its reservation times out
+	Failed []int
+	// Undeleted are the IDs of the messages that were handled but couldn't be deleted. They stay
+	// reserved, and are redelivered once their reservations time out
+	Undeleted []int
+}
+
+// Drain reserves messages from qName num at a time with the given timeout and passes each one to
+// h, deleting it after h returns nil, until the queue has no more messages available. Returns
+// the IDs of the processed messages along with a nil error once the queue is empty.
+//
+// Drain stops before handling the next message once ctx.Done() receives, h returns an error, or
+// a reserve or delete request fails, and returns the error. Before returning, it releases every
+// message it still holds that wasn't handled, and the one h failed on, which is in Failed rather
+// than Released, so that none of them stay reserved until their reservation times out. A message that h handled is deleted
+// rather than released, even if ctx is done by then, and is in Undeleted if that fails. The
+// deletes and releases use contexts of their own, since ctx may be done by then. A message whose
+// release fails is in none of the lists of the result, and becomes available again once its
+// reservation times out. The error that stopped Drain is returned even if releasing failed.
+//
+// h should finish well within timeout, since reservations aren't extended while Drain holds them
+func Drain(ctx context.Context, cl Client, token, projID, qName string, num int, timeout Timeout, h func(ctx context.Context, msg DequeuedMessage) error) (*Drained, error) {
+	drained := &Drained{}
+	for {
+		msgs, err := cl.Dequeue(ctx, token, projID, qName, num, timeout, Wait(0), false)
+		if err != nil {
+			if ctx.Err() != nil {
+				return drained, ctx.Err()
+			}
+			return drained, err
+		}
+		if len(msgs) == 0 {
+			return drained, nil
+		}
+		for i, msg := range msgs {
+			if err := ctx.Err(); err != nil {
+				drained.Released = releaseAll(cl, token, projID, qName, msgs[i:])
+				return drained, err
+			}
+			if err := h(ctx, msg); err != nil {
+				drained.Failed = []int{msg.ID}
+				releaseAll(cl, token, projID, qName, msgs[i:i+1])
+				drained.Released = releaseAll(cl, token, projID, qName, msgs[i+1:])
+				return drained, err
+			}
+			if err := deleteHandled(cl, token, projID, qName, msg); err != nil {
+				drained.Undeleted = append(drained.Undeleted, msg.ID)
+				drained.Released = releaseAll(cl, token, projID, qName, msgs[i+1:])
+				return drained, err
+			}
+			drained.Processed = append(drained.Processed, msg.ID)
+		}
+	}
+}
+
+// deleteHandled deletes msg, which was handled, with a context of its own
+func deleteHandled(cl Client, token, projID, qName string, msg DequeuedMessage) error {
+	ctx, cancel := context.WithTimeout(context.Background(), drainReleaseTimeout)
+	defer cancel()
+	_, err := cl.DeleteReserved(ctx, token, projID, qName, msg.ID, msg.ReservationID)
+	return err
+}
+
+// releaseAll releases msgs with no delay and returns the IDs of the ones that were released
+func releaseAll(cl Client, token, projID, qName string, msgs []DequeuedMessage) []int {
+	ctx, cancel := context.WithTimeout(context.Background(), drainReleaseTimeout)
+	defer cancel()
+	var released []int
+	for _, msg := range msgs {
+		if _, err := cl.ReleaseReserved(ctx, token, projID, qName, msg.ID, msg.ReservationID, 0); err != nil {
+			continue
+		}
+		released = append(released, msg.ID)
+	}
+	return released
+}
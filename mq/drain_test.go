@@ -0,0 +1,108 @@
+package mq
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/arschles/assert"
+	"github.com/arschles/testsrv"
+	"golang.org/x/net/context"
+)
+
+func TestDrain(t *testing.T) {
+	cl := NewMemClient()
+	enqueueBodies(t, cl, "a", "b", "c")
+	var bodies []string
+	drained, err := Drain(bgCtx, cl, token, projID, qName, 2, Timeout(30), func(ctx context.Context, msg DequeuedMessage) error {
+		bodies = append(bodies, msg.Body)
+		return nil
+	})
+	assert.NoErr(t, err)
+	assert.Equal(t, bodies, []string{"a", "b", "c"}, "handled bodies")
+	assert.Equal(t, len(drained.Processed), 3, "number of processed messages")
+	assert.Equal(t, len(drained.Released), 0, "number of released messages")
+	assert.Equal(t, queueSize(t, cl), 0, "queue size")
+}
+
+func TestDrainReleasesOnError(t *testing.T) {
+	cl := NewMemClient()
+	enqueueBodies(t, cl, "a", "b", "c", "d")
+	handlerErr := errors.New("handler failed")
+	drained, err := Drain(bgCtx, cl, token, projID, qName, 10, Timeout(30), func(ctx context.Context, msg DequeuedMessage) error {
+		if msg.Body == "b" {
+			return handlerErr
+		}
+		return nil
+	})
+	assert.Err(t, handlerErr, err)
+	assert.Equal(t, len(drained.Processed), 1, "number of processed messages")
+	assert.Equal(t, len(drained.Failed), 1, "number of failed messages")
+	assert.Equal(t, len(drained.Released), 2, "number of released messages")
+	msgs, err := cl.Peek(bgCtx, token, projID, qName, MaxPeek)
+	assert.NoErr(t, err)
+	assert.Equal(t, len(msgs), 3, "number of available messages")
+}
+
+func TestDrainReleasesOnCancel(t *testing.T) {
+	cl := NewMemClient()
+	enqueueBodies(t, cl, "a", "b", "c")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	drained, err := Drain(ctx, cl, token, projID, qName, 10, Timeout(30), func(ctx context.Context, msg DequeuedMessage) error {
+		cancel()
+		return nil
+	})
+	assert.Err(t, context.Canceled, err)
+	// the message that was being handled when ctx was cancelled is still deleted
+	assert.Equal(t, len(drained.Processed), 1, "number of processed messages")
+	assert.Equal(t, len(drained.Released), 2, "number of released messages")
+	msgs, err := cl.Peek(bgCtx, token, projID, qName, MaxPeek)
+	assert.NoErr(t, err)
+	assert.Equal(t, len(msgs), 2, "number of available messages")
+}
+
+func TestHTTPDrainReleasesOnCancel(t *testing.T) {
+	var mtx sync.Mutex
+	var deleted, released []string
+	srv := testsrv.StartServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/reservations"):
+			json.NewEncoder(w).Encode(dequeueResp{Messages: []DequeuedMessage{
+				{ID: 1, ReservationID: "r1"},
+				{ID: 2, ReservationID: "r2"},
+				{ID: 3, ReservationID: "r3"},
+			}})
+		case strings.HasSuffix(r.URL.Path, "/release"):
+			released = append(released, r.URL.Path)
+			w.Write([]byte(`{"msg":"Released"}`))
+		case r.Method == "DELETE":
+			deleted = append(deleted, r.URL.Path)
+			w.Write([]byte(`{"msg":"Deleted"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	cl := newTestHTTPClient(t, srv)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	drained, err := Drain(ctx, cl, token, projID, qName, 10, Timeout(30), func(ctx context.Context, msg DequeuedMessage) error {
+		cancel()
+		return nil
+	})
+	assert.Err(t, context.Canceled, err)
+	// the handled message is deleted even though ctx is done by the time it's deleted
+	assert.Equal(t, drained.Processed, []int{1}, "processed messages")
+	assert.Equal(t, drained.Released, []int{2, 3}, "released messages")
+	assert.Equal(t, len(drained.Undeleted), 0, "number of undeleted messages")
+	mtx.Lock()
+	defer mtx.Unlock()
+	assert.Equal(t, len(deleted), 1, "number of delete requests")
+	assert.Equal(t, len(released), 2, "number of release requests")
+}
@@ -0,0 +1,88 @@
+package mq
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// HeaderEnqueuedAt is the push header that HTTPClients created with WithDwellTime stamp enqueued
+// messages with. Its value is the time of the enqueue on the server's clock, in nanoseconds since
+// the Unix epoch
+const HeaderEnqueuedAt = "X-Gorion-Enqueued-At"
+
+// dateResolution is the resolution of the Date header, which is in whole seconds
+const dateResolution = time.Second
+
+// EnqueuedAt returns the time msg was enqueued on the server's clock, from its HeaderEnqueuedAt
+// push header. Returns false if msg has no valid HeaderEnqueuedAt push header, which is always
+// the case if it wasn't enqueued by a client created with WithDwellTime, or if the server didn't
+// return push headers with the message
+func EnqueuedAt(msg DequeuedMessage) (time.Time, bool) {
+	val, ok := msg.PushHeaders[HeaderEnqueuedAt]
+	if !ok {
+		return time.Time{}, false
+	}
+	nanos, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, nanos), true
+}
+
+// ServerTime returns the current time on the IronMQ server's clock, as estimated from the Date
+// header of the most recent response the client got. Before the first response, it's the local
+// time. Since the Date header is in whole seconds, the estimate is only accurate to about half a
+// second, but that's enough to keep clock skew between hosts from dominating measurements that
+// compare times taken on different hosts
+func (h *HTTPClient) ServerTime() time.Time {
+	return time.Now().Add(time.Duration(atomic.LoadInt64(&h.serverOffset)))
+}
+
+// observeServerDate updates the estimate of the server's clock from the Date header of resp,
+// which was received at received. Responses without a valid Date header are ignored
+func (h *HTTPClient) observeServerDate(resp *http.Response, received time.Time) {
+	date, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return
+	}
+	// the Date header is truncated to the second, so the server's time was halfway into it on average
+	offset := date.Add(dateResolution / 2).Sub(received)
+	atomic.StoreInt64(&h.serverOffset, int64(offset))
+}
+
+// stampEnqueuedAt returns copies of msgs with HeaderEnqueuedAt push headers for the given time.
+// The push headers of msgs aren't modified
+func stampEnqueuedAt(msgs []NewMessage, at time.Time) []NewMessage {
+	val := strconv.FormatInt(at.UnixNano(), 10)
+	ret := make([]NewMessage, len(msgs))
+	for i, msg := range msgs {
+		headers := make(map[string]string, len(msg.PushHeaders)+1)
+		for k, v := range msg.PushHeaders {
+			headers[k] = v
+		}
+		headers[HeaderEnqueuedAt] = val
+		msg.PushHeaders = headers
+		ret[i] = msg
+	}
+	return ret
+}
+
+// observeDwell reports the dwell time of each of msgs that has a HeaderEnqueuedAt push header to
+// the metrics recorder. Dwell times that come out negative because of the inaccuracy of the
+// server time estimates are reported as 0
+func (h *HTTPClient) observeDwell(qName string, msgs []DequeuedMessage) {
+	now := h.ServerTime()
+	for _, msg := range msgs {
+		at, ok := EnqueuedAt(msg)
+		if !ok {
+			continue
+		}
+		dwell := now.Sub(at)
+		if dwell < 0 {
+			dwell = 0
+		}
+		h.metrics.ObserveDwell(qName, dwell)
+	}
+}
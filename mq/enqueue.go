@@ -0,0 +1,99 @@
+package mq
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+var (
+	// ErrEnqueuedNoID is returned when an enqueue operation succeeded but didn't return the ID of
+	// the new message
+	ErrEnqueuedNoID = errors.New("enqueue returned no message ID")
+)
+
+// availablePollInterval is how often EnqueueAndWaitAvailable peeks at the queue
+const availablePollInterval = 250 * time.Millisecond
+
+// EnqueueAndWaitAvailable enqueues msg onto qName and then blocks until the new message is
+// available to be reserved, which for a message with a delay is after the delay elapses. It's
+// intended for tests of delayed message flows that need to know when a message is reservable.
+//
+// Availability is checked by periodically peeking at the front of the queue, so the message is
+// only seen once it's among the first MaxPeek available messages, and may be reserved by another
+// consumer in the time between a peek and EnqueueAndWaitAvailable returning.
+//
+// If the enqueue fails, returns nil and the error. If ctx.Done() receives or a peek fails after
+// the message was enqueued, returns the result of the enqueue along with the error
+func EnqueueAndWaitAvailable(ctx context.Context, cl Client, token, projID, qName string, msg NewMessage) (*Enqueued, error) {
+	enq, err := cl.Enqueue(ctx, token, projID, qName, []NewMessage{msg})
+	if err != nil {
+		return nil, err
+	}
+	if len(enq.IDs) < 1 {
+		return enq, ErrEnqueuedNoID
+	}
+	id := enq.IDs[0]
+	ticker := time.NewTicker(availablePollInterval)
+	defer ticker.Stop()
+	for {
+		msgs, err := cl.Peek(ctx, token, projID, qName, MaxPeek)
+		if err != nil {
+			return enq, err
+		}
+		for _, msg := range msgs {
+			if strconv.Itoa(msg.ID) == id {
+				return enq, nil
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return enq, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// EnqueueStaggered enqueues msgs onto qName in a single request, giving each one a delay that's
+// spacing longer than the one before it: the first message has no delay, the second is delayed
+// by spacing, the third by twice spacing, and so on. This spreads the availability of a burst of
+// messages out over time. The delays msgs already have are replaced, and msgs itself isn't modified.
+//
+// Delays are whole seconds, so each message's delay is rounded down to the nearest second.
+// Returns nil and ErrDelayOutOfRange without enqueueing anything if spacing is negative or the
+// delay of the last message would be more than MaxDelay
+func EnqueueStaggered(ctx context.Context, cl Client, token, projID, qName string, msgs []NewMessage, spacing time.Duration) (*Enqueued, error) {
+	if spacing < 0 {
+		return nil, ErrDelayOutOfRange
+	}
+	if len(msgs) > 0 && spacing > 0 && time.Duration(len(msgs)-1) > MaxDelay*time.Second/spacing {
+		return nil, ErrDelayOutOfRange
+	}
+	staggered := make([]NewMessage, len(msgs))
+	for i, msg := range msgs {
+		msg.Delay = uint32(time.Duration(i) * spacing / time.Second)
+		staggered[i] = msg
+	}
+	return cl.Enqueue(ctx, token, projID, qName, staggered)
+}
+
+// SuggestBatchSize returns how many messages with bodies and push headers of avgMsgBytes bytes on
+// average to put in each batch passed to Enqueue, so that every batch fits in a single enqueue
+// request with room to spare. The result is at most MaxEnqueueBatch, and keeps the messages plus
+// EnqueueMsgOverheadBytes per message under SuggestedBatchBytes. It's always at least 1, even
+// for messages that are too big to be enqueued at all
+func SuggestBatchSize(avgMsgBytes int) int {
+	if avgMsgBytes < 0 {
+		avgMsgBytes = 0
+	}
+	n := SuggestedBatchBytes / (avgMsgBytes + EnqueueMsgOverheadBytes)
+	if n > MaxEnqueueBatch {
+		return MaxEnqueueBatch
+	}
+	if n < 1 {
+		return 1
+	}
+	return n
+}
@@ -0,0 +1,62 @@
+package mq
+
+import (
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+	"golang.org/x/net/context"
+)
+
+func TestEnqueueAndWaitAvailable(t *testing.T) {
+	cl := NewMemClient()
+	msg := NewMessage{Body: "abc", Delay: 1, PushHeaders: make(map[string]string)}
+	enq, err := EnqueueAndWaitAvailable(bgCtx, cl, token, projID, qName, msg)
+	assert.NoErr(t, err)
+	assert.Equal(t, len(enq.IDs), 1, "number of enqueued IDs")
+	msgs, err := cl.Dequeue(bgCtx, token, projID, qName, 1, Timeout(30), Wait(0), false)
+	assert.NoErr(t, err)
+	assert.Equal(t, len(msgs), 1, "number of dequeued messages")
+}
+
+func TestEnqueueAndWaitAvailableCancelled(t *testing.T) {
+	cl := NewMemClient()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	msg := NewMessage{Body: "abc", Delay: 60, PushHeaders: make(map[string]string)}
+	enq, err := EnqueueAndWaitAvailable(ctx, cl, token, projID, qName, msg)
+	assert.Err(t, context.DeadlineExceeded, err)
+	assert.Equal(t, len(enq.IDs), 1, "number of enqueued IDs")
+}
+
+func TestEnqueueStaggered(t *testing.T) {
+	cl := NewMemClient()
+	msgs := []NewMessage{
+		{Body: "abc", PushHeaders: make(map[string]string)},
+		{Body: "def", PushHeaders: make(map[string]string)},
+	}
+	_, err := EnqueueStaggered(bgCtx, cl, token, projID, qName, msgs, -time.Second)
+	assert.Err(t, ErrDelayOutOfRange, err)
+	_, err = EnqueueStaggered(bgCtx, cl, token, projID, qName, msgs, (MaxDelay+1)*time.Second)
+	assert.Err(t, ErrDelayOutOfRange, err)
+	_, err = cl.GetQueueInfo(bgCtx, token, projID, qName)
+	assert.Err(t, ErrNoSuchQueue, err)
+
+	enq, err := EnqueueStaggered(bgCtx, cl, token, projID, qName, msgs, time.Minute)
+	assert.NoErr(t, err)
+	assert.Equal(t, len(enq.IDs), 2, "number of enqueued IDs")
+	assert.Equal(t, msgs[1].Delay, uint32(0), "delay of the caller's message")
+	available, err := cl.Peek(bgCtx, token, projID, qName, MaxPeek)
+	assert.NoErr(t, err)
+	assert.Equal(t, len(available), 1, "number of available messages")
+	assert.Equal(t, available[0].Body, "abc", "available message body")
+}
+
+func TestSuggestBatchSize(t *testing.T) {
+	assert.Equal(t, SuggestBatchSize(0), MaxEnqueueBatch, "batch size for empty messages")
+	assert.Equal(t, SuggestBatchSize(100), MaxEnqueueBatch, "batch size for small messages")
+	n := SuggestBatchSize(10 * 1024)
+	assert.True(t, n > 1 && n < MaxEnqueueBatch, "batch size [%d] for 10KB messages out of range", n)
+	assert.True(t, n*(10*1024+EnqueueMsgOverheadBytes) <= SuggestedBatchBytes, "batch of [%d] 10KB messages is too big", n)
+	assert.Equal(t, SuggestBatchSize(MaxEnqueueBatchBytes), 1, "batch size for huge messages")
+}
@@ -1,12 +1,21 @@
 package mq
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"mime"
+	"net"
 	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/arschles/gorion"
 	"golang.org/x/net/context"
@@ -35,8 +44,105 @@ func (s Scheme) String() string {
 var (
 	// ErrInvalidScheme is returned from any func that converts something to a Scheme when the value is an invalid scheme
 	ErrInvalidScheme = errors.New("invalid scheme")
+	// ErrUnexpectedContentType matches every *UnexpectedContentTypeError with errors.Is
+	ErrUnexpectedContentType = errors.New("unexpected response content type")
 )
 
+// UnexpectedContentTypeError is returned from HTTPClient funcs when a successful response has an
+// HTML body instead of JSON, which usually means that a load balancer or proxy answered instead
+// of IronMQ, for example because the request was routed to the wrong place
+type UnexpectedContentTypeError struct {
+	// StatusCode is the status code of the response
+	StatusCode int
+	// ContentType is the Content-Type header of the response
+	ContentType string
+	// Snippet is the beginning of the response body
+	Snippet string
+}
+
+// Error is the error interface implementation
+func (u *UnexpectedContentTypeError) Error() string {
+	return fmt.Sprintf("expected JSON but got status [%d] with content type [%s] and body [%s]", u.StatusCode, u.ContentType, u.Snippet)
+}
+
+// Is returns true if target is ErrUnexpectedContentType
+func (u *UnexpectedContentTypeError) Is(target error) bool {
+	return target == ErrUnexpectedContentType
+}
+
+// ResponseTooLargeError is returned from HTTPClient funcs when the body of a successful response
+// is bigger than the limit the client was created with (see WithMaxResponseBytes)
+type ResponseTooLargeError struct {
+	// Limit is the maximum number of bytes the client accepts in a response body
+	Limit int64
+}
+
+// Error is the error interface implementation
+func (r *ResponseTooLargeError) Error() string {
+	return fmt.Sprintf("response body is larger than the limit of [%d] bytes", r.Limit)
+}
+
+// maxSnippetBytes is the maximum length of UnexpectedContentTypeError.Snippet
+const maxSnippetBytes = 256
+
+// checkContentType returns an *UnexpectedContentTypeError if resp has an HTML content type or its
+// body, which is read through body, starts with a '<'. Otherwise returns body
+func checkContentType(resp *http.Response, body *bufio.Reader) (io.Reader, error) {
+	ct := resp.Header.Get("Content-Type")
+	mediaType, _, _ := mime.ParseMediaType(ct)
+	html := mediaType == "text/html" || mediaType == "application/xhtml+xml"
+	if !html {
+		// a leading '<' can't start a JSON value, so there's no point in trying to decode it
+		start, _ := body.Peek(maxSnippetBytes)
+		start = bytes.TrimLeft(start, " \t\r\n")
+		html = len(start) > 0 && start[0] == '<'
+	}
+	if !html {
+		return body, nil
+	}
+	snippet, _ := ioutil.ReadAll(io.LimitReader(body, maxSnippetBytes))
+	return nil, &UnexpectedContentTypeError{
+		StatusCode:  resp.StatusCode,
+		ContentType: ct,
+		Snippet:     strings.TrimSpace(string(snippet)),
+	}
+}
+
+// HTTPError is returned from HTTPClient funcs when the IronMQ API responds with a non-2xx status code
+// that the client wasn't configured to accept with WithSuccessStatuses
+type HTTPError struct {
+	// StatusCode is the status code of the response
+	StatusCode int
+	// Msg is the error message in the response body, or the entire body if it didn't contain one
+	Msg string
+}
+
+// Error is the error interface implementation
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("IronMQ returned status [%d] with message [%s]", e.StatusCode, e.Msg)
+}
+
+// maxErrBodyBytes is the maximum number of bytes read from the body of a non-2xx response
+const maxErrBodyBytes = 4096
+
+// newHTTPError reads the error message from resp's body and returns an *HTTPError for it
+func newHTTPError(resp *http.Response) *HTTPError {
+	ret := &HTTPError{StatusCode: resp.StatusCode}
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrBodyBytes))
+	if err != nil {
+		return ret
+	}
+	msg := struct {
+		Msg string `json:"msg"`
+	}{}
+	if err := json.Unmarshal(b, &msg); err == nil && msg.Msg != "" {
+		ret.Msg = msg.Msg
+	} else {
+		ret.Msg = strings.TrimSpace(string(b))
+	}
+	return ret
+}
+
 const (
 	// SchemeHTTP represents http
 	SchemeHTTP = "http"
@@ -55,65 +161,325 @@ type HTTPClient struct {
 	transport  *http.Transport
 	client     *http.Client
 	oauthToken string
+	metrics    MetricsRecorder
+	// the retry policy for DeleteReserved
+	deleteRetries retryPolicy
+	// reports whether an error response is retryable in addition to the standard ones, if non-nil
+	retryableMsg func(status int, msg string) bool
+	// injects trace context into enqueued messages' push headers, if non-nil
+	traceInjector TraceInjector
+	// status codes that are treated as success in addition to 2xx
+	successStatuses map[int]bool
+	// whether to send the token in the oauth query parameter instead of the Authorization header
+	tokenInQuery bool
+	// the maximum total body size of the messages in each enqueue request
+	maxBatchBytes int
+	// encodes the bodies of enqueued messages, if non-nil
+	bodyCodec BodyCodec
+	// whether to stream the JSON of enqueue requests instead of buffering it
+	streamingEncode bool
+	// the config that queues are created with when they're not found, if non-nil
+	autoCreateQueue *QueueConfig
+	// whether to report connection reuse to the metrics recorder
+	connTrace bool
+	// whether Dequeue refuses to reserve from push queues
+	pushGuard bool
+	// whether each queue is a push queue, by qKey, once the push guard looked it up
+	pushQueues sync.Map
+	// whether to stamp enqueued messages and report the dwell time of reserved ones
+	dwellTime bool
+	// the maximum size of successful response bodies, or 0 for no limit
+	maxResponseBytes int64
+	// whether Enqueue returns the URLs of the enqueued messages
+	messageURLs bool
+	// called when Dequeue with delete gets more messages than it requested, if non-nil
+	dequeueCountWarning func(*DequeueCountError)
+	// the estimated offset of the server's clock from the local one in nanoseconds, accessed
+	// atomically
+	serverOffset int64
 }
 
-// NewHTTPClient returns a new HTTPClient that talks to the IronMQ v3 API at {scheme}://{host}:{port}
-func NewHTTPClient(scheme Scheme, host string, port uint16) *HTTPClient {
+// NewHTTPClient returns a new HTTPClient that talks to the IronMQ v3 API at {scheme}://{host}:{port}.
+// Any opts are applied to the new client in order
+func NewHTTPClient(scheme Scheme, host string, port uint16, opts ...HTTPClientOption) *HTTPClient {
 	transport := &http.Transport{}
 	client := &http.Client{Transport: transport}
-	return &HTTPClient{
-		scheme:    scheme,
-		host:      host,
-		port:      port,
-		transport: transport,
-		client:    client,
+	h := &HTTPClient{
+		scheme:        scheme,
+		host:          host,
+		port:          port,
+		transport:     transport,
+		client:        client,
+		metrics:       NopMetrics{},
+		maxBatchBytes: MaxEnqueueBatchBytes,
 	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
+}
+
+// ResolveHost looks up the host that h talks to, and returns an error if it can't be resolved.
+// Call it right after NewHTTPClient to catch a misconfigured host at startup instead of on the
+// first request, which otherwise fails only after the dial times out. The result isn't cached;
+// the transport resolves the host again as usual when it connects
+func (h *HTTPClient) ResolveHost(ctx context.Context) error {
+	_, err := net.DefaultResolver.LookupHost(ctx, h.host)
+	return err
+}
+
+// url returns the URL of path in the project with the given ID, without a token
+func (h *HTTPClient) url(projID, path string) string {
+	return fmt.Sprintf("%s://%s:%d/3/projects/%s/%s", h.scheme, h.host, h.port, projID, path)
 }
 
-// headers sets json and oauth headers on r
+// newReq creates a request to path, which may include a query string, with the json and oauth
+// headers set. If h.tokenInQuery is true, the token is added to the query instead
 func (h *HTTPClient) newReq(method, token, projID, path string, body io.Reader) (*http.Request, error) {
-	urlStr := fmt.Sprintf("%s://%s:%d/3/projects/%s/%s", h.scheme, h.host, h.port, projID, path)
-	req, err := http.NewRequest(method, urlStr, body)
+	req, err := http.NewRequest(method, h.url(projID, path), body)
 	if err != nil {
 		return nil, err
 	}
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "OAuth "+token)
+	if h.tokenInQuery {
+		query := req.URL.Query()
+		query.Set("oauth", token)
+		req.URL.RawQuery = query.Encode()
+	} else {
+		req.Header.Set("Authorization", "OAuth "+token)
+	}
 	return req, nil
 }
 
-type enqueueReq struct {
-	Messages []NewMessage `json:"messages"`
-}
+// redactedToken replaces the token in the oauth query parameter of URLs in errors
+const redactedToken = "REDACTED"
 
-// Enqueue is the Client implementation for the v3 API http://dev.iron.io/mq/3/reference/api/#post-messages
-func (h *HTTPClient) Enqueue(ctx context.Context, token, projID, qName string, msgs []NewMessage) (*Enqueued, error) {
-	reqBody := &bytes.Buffer{}
-	if err := json.NewEncoder(reqBody).Encode(enqueueReq{Messages: msgs}); err != nil {
-		return nil, err
+// redactToken returns a copy of err with the oauth query parameter in its URL replaced with
+// redactedToken if it's a *url.Error, since net/http puts the full request URL in those and the
+// token is in it with WithTokenInQuery. Other errors are returned as is
+func redactToken(err error) error {
+	urlErr, ok := err.(*url.Error)
+	if !ok {
+		return err
+	}
+	u, parseErr := url.Parse(urlErr.URL)
+	if parseErr != nil {
+		return &url.Error{Op: urlErr.Op, URL: redactedToken, Err: urlErr.Err}
+	}
+	query := u.Query()
+	if _, ok := query["oauth"]; !ok {
+		return err
 	}
+	query.Set("oauth", redactedToken)
+	u.RawQuery = query.Encode()
+	return &url.Error{Op: urlErr.Op, URL: u.String(), Err: urlErr.Err}
+}
 
-	req, err := h.newReq("POST", token, projID, fmt.Sprintf("queues/%s/messages", qName), reqBody)
+// do sends a method request to path with the JSON encoding of reqBody (if it's non-nil) as the
+// body, and decodes the response into ret. Returns an *HTTPError if the API responded with a
+// non-2xx status code that's not one of h.successStatuses. The request is reported to the
+// metrics recorder as op
+func (h *HTTPClient) do(ctx context.Context, op, method, token, projID, path string, reqBody, ret interface{}) error {
+	var body io.Reader
+	if h.streamingEncode && op == OpEnqueue && reqBody != nil {
+		pr, pw := io.Pipe()
+		// closing the reader when the request is done makes the encoder fail and return if the
+		// transport stopped reading the body early
+		defer pr.Close()
+		go func() {
+			pw.CloseWithError(json.NewEncoder(pw).Encode(reqBody))
+		}()
+		body = pr
+	} else {
+		buf := &bytes.Buffer{}
+		if reqBody != nil {
+			if err := json.NewEncoder(buf).Encode(reqBody); err != nil {
+				return err
+			}
+		}
+		body = buf
+	}
+	req, err := h.newReq(method, token, projID, path, body)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	// HTTPDo can only cancel requests on h.transport, so the request also carries ctx for round
+	// trippers passed to WithRoundTripper
+	req = req.WithContext(ctx)
+	if h.connTrace {
+		trace := &httptrace.ClientTrace{
+			GotConn: func(info httptrace.GotConnInfo) {
+				h.metrics.ObserveConn(op, info.Reused)
+			},
+		}
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
 	}
-	ret := new(Enqueued)
 	doFunc := func(resp *http.Response, err error) error {
 		if err != nil {
-			return err
+			return redactToken(err)
 		}
 		defer resp.Body.Close()
-		if err := json.NewDecoder(resp.Body).Decode(ret); err != nil {
+		h.observeServerDate(resp, time.Now())
+		is2xx := resp.StatusCode >= 200 && resp.StatusCode <= 299
+		extra := h.successStatuses[resp.StatusCode]
+		if !is2xx && !extra {
+			return newHTTPError(resp)
+		}
+		br := getBufReader(resp.Body)
+		defer putBufReader(br)
+		body, err := checkContentType(resp, br)
+		if err != nil {
+			return err
+		}
+		// the body is read until EOF rather than for its Content-Length, which responses with
+		// chunked transfer encoding don't have
+		if h.maxResponseBytes > 0 {
+			body = io.LimitReader(body, h.maxResponseBytes+1)
+		}
+		buf := getBuf()
+		defer putBuf(buf)
+		if _, err := buf.ReadFrom(body); err != nil {
 			return err
 		}
-		return nil
+		if h.maxResponseBytes > 0 && int64(buf.Len()) > h.maxResponseBytes {
+			return &ResponseTooLargeError{Limit: h.maxResponseBytes}
+		}
+		// the extra success statuses might come from a gateway that doesn't send a body
+		if extra && len(bytes.TrimSpace(buf.Bytes())) == 0 {
+			return nil
+		}
+		return json.Unmarshal(buf.Bytes(), ret)
 	}
-	if err := gorion.HTTPDo(ctx, h.client, h.transport, req, doFunc); err != nil {
+	start := time.Now()
+	err = gorion.HTTPDo(ctx, h.client, h.transport, req, doFunc)
+	h.metrics.ObserveRequest(op, time.Since(start), err)
+	return err
+}
+
+type enqueueReq struct {
+	Messages []NewMessage `json:"messages"`
+}
+
+// Enqueue is the Client implementation for the v3 API http://dev.iron.io/mq/3/reference/api/#post-messages.
+//
+// msgs are sent in as many requests as needed to keep each one within MaxEnqueueBatch messages
+// and the client's batch byte budget (see WithMaxBatchBytes), in order. The budget applies to the
+// messages as they're sent, with encoded bodies if the client was created with WithBodyCodec
+// and with the push headers added by WithTracePropagation and WithDwellTime. A message that's
+// bigger than the budget by itself is sent in a request of its own. The returned IDs are those of
+// all the requests combined.
+//
+// If a request fails, the messages sent in earlier requests stay enqueued. If there are any,
+// Enqueue returns nil and a *PartialEnqueueError with their IDs, which are those of the first
+// messages of msgs, in order, so that the caller can send only the rest again. Otherwise it
+// returns nil and the error of the failed request
+func (h *HTTPClient) Enqueue(ctx context.Context, token, projID, qName string, msgs []NewMessage) (*Enqueued, error) {
+	if err := checkMessageIDs(msgs); err != nil {
 		return nil, err
 	}
+	if h.traceInjector != nil {
+		msgs = h.injectTrace(ctx, msgs)
+	}
+	if h.dwellTime {
+		msgs = stampEnqueuedAt(msgs, h.ServerTime())
+	}
+	if h.bodyCodec != nil {
+		encoded := make([]NewMessage, len(msgs))
+		for i, msg := range msgs {
+			enc, err := encodeBody(msg, h.bodyCodec)
+			if err != nil {
+				return nil, err
+			}
+			encoded[i] = enc
+		}
+		msgs = encoded
+	}
+	chunks := chunkMessages(msgs, MaxEnqueueBatch, h.maxBatchBytes)
+	if len(chunks) == 0 {
+		chunks = [][]NewMessage{msgs}
+	}
+	ret := new(Enqueued)
+	for _, chunk := range chunks {
+		enq := new(Enqueued)
+		err := h.onQueue(ctx, token, projID, qName, func() error {
+			return h.do(ctx, OpEnqueue, "POST", token, projID, fmt.Sprintf("queues/%s/messages", qName), enqueueReq{Messages: chunk}, enq)
+		})
+		if err != nil && len(ret.IDs) > 0 {
+			h.setMessageURLs(projID, qName, ret)
+			return nil, &PartialEnqueueError{Enqueued: ret, Err: err}
+		} else if err != nil {
+			return nil, err
+		}
+		ret.IDs = append(ret.IDs, enq.IDs...)
+		ret.Msg = enq.Msg
+		ret.QueueSize = enq.QueueSize
+	}
+	h.setMessageURLs(projID, qName, ret)
 	return ret, nil
 }
 
+// setMessageURLs sets the URLs of enq's messages if the client was created with WithMessageURLs
+func (h *HTTPClient) setMessageURLs(projID, qName string, enq *Enqueued) {
+	if !h.messageURLs {
+		return
+	}
+	enq.URLs = make([]string, len(enq.IDs))
+	for i, id := range enq.IDs {
+		enq.URLs[i] = h.url(projID, fmt.Sprintf("queues/%s/messages/%s", qName, id))
+	}
+}
+
+// PartialEnqueueError is returned from HTTPClient.Enqueue when it sent the messages in more than
+// one request and one of them failed after earlier ones succeeded
+type PartialEnqueueError struct {
+	// Enqueued holds the IDs, and URLs if requested, of the messages that were enqueued before
+	// the failure. They're those of the first len(Enqueued.IDs) messages passed to Enqueue
+	Enqueued *Enqueued
+	// Err is the error of the request that failed
+	Err error
+}
+
+// Error is the error interface implementation
+func (p *PartialEnqueueError) Error() string {
+	return fmt.Sprintf("enqueued only [%d] messages [%s]", len(p.Enqueued.IDs), p.Err)
+}
+
+// Unwrap returns the error of the request that failed
+func (p *PartialEnqueueError) Unwrap() error {
+	return p.Err
+}
+
+// DequeueCountError describes a response to HTTPClient.Dequeue with delete set to true that had
+// more messages than were requested. It's passed to the func given to WithDequeueCountWarning
+// rather than returned, since the API already deleted every message it returned, so all of them
+// are returned to the caller rather than being dropped
+type DequeueCountError struct {
+	// Requested is the number of messages that were requested
+	Requested int
+	// Returned is the number of messages that the API returned
+	Returned int
+}
+
+// Error is the error interface implementation
+func (d *DequeueCountError) Error() string {
+	return fmt.Sprintf("requested [%d] messages with delete but got [%d]", d.Requested, d.Returned)
+}
+
+// injectTrace returns a copy of msgs with trace context injected into copies of their push headers
+func (h *HTTPClient) injectTrace(ctx context.Context, msgs []NewMessage) []NewMessage {
+	ret := make([]NewMessage, len(msgs))
+	for i, msg := range msgs {
+		headers := make(map[string]string, len(msg.PushHeaders))
+		for k, v := range msg.PushHeaders {
+			headers[k] = v
+		}
+		h.traceInjector(ctx, headers)
+		msg.PushHeaders = headers
+		ret[i] = msg
+	}
+	return ret
+}
+
 type dequeueReq struct {
 	Num     int  `json:"n"`
 	Timeout int  `json:"timeout"`
@@ -125,7 +491,12 @@ type dequeueResp struct {
 	Messages []DequeuedMessage `json:"messages"`
 }
 
-// Dequeue is the client implementation for the v3 API (http://dev.iron.io/mq/3/reference/api/#reserve-messages)
+// Dequeue is the client implementation for the v3 API (http://dev.iron.io/mq/3/reference/api/#reserve-messages).
+//
+// When delete is true, there's no way to find out from the API whether each message was actually
+// deleted, but Dequeue does check that no more messages than num came back. If more did, it
+// still returns all of them with a nil error, and reports a *DequeueCountError to the func given
+// to WithDequeueCountWarning, if any
 func (h *HTTPClient) Dequeue(ctx context.Context, token, projID, qName string, num int, timeout Timeout, wait Wait, delete bool) ([]DequeuedMessage, error) {
 	if !timeoutInRange(timeout) {
 		return nil, ErrTimeoutOutOfRange
@@ -133,28 +504,34 @@ func (h *HTTPClient) Dequeue(ctx context.Context, token, projID, qName string, n
 	if !waitInRange(wait) {
 		return nil, ErrWaitOutOfRange
 	}
-
-	body := &bytes.Buffer{}
-	if err := json.NewEncoder(body).Encode(dequeueReq{Num: num, Timeout: int(timeout), Wait: int(wait), Delete: delete}); err != nil {
-		return nil, err
+	if h.pushGuard {
+		if err := h.guardPush(ctx, token, projID, qName); err != nil {
+			return nil, err
+		}
 	}
-	req, err := h.newReq("POST", token, projID, fmt.Sprintf("queues/%s/reservations", qName), body)
+
+	reqBody := dequeueReq{Num: num, Timeout: int(timeout), Wait: int(wait), Delete: delete}
+	ret := new(dequeueResp)
+	err := h.onQueue(ctx, token, projID, qName, func() error {
+		return h.do(ctx, OpDequeue, "POST", token, projID, fmt.Sprintf("queues/%s/reservations", qName), reqBody, ret)
+	})
 	if err != nil {
 		return nil, err
 	}
-	ret := new(dequeueResp)
-	doFunc := func(resp *http.Response, err error) error {
-		if err != nil {
-			return err
-		}
-		defer resp.Body.Close()
-		if err := json.NewDecoder(resp.Body).Decode(ret); err != nil {
-			return err
+	numBytes, numRedelivered := 0, 0
+	for _, msg := range ret.Messages {
+		numBytes += msg.Size()
+		if msg.IsRedelivery() {
+			numRedelivered++
 		}
-		return nil
 	}
-	if err := gorion.HTTPDo(ctx, h.client, h.transport, req, doFunc); err != nil {
-		return nil, err
+	h.metrics.ObserveReserved(qName, len(ret.Messages), numBytes)
+	h.metrics.ObserveRedelivered(qName, numRedelivered)
+	if h.dwellTime {
+		h.observeDwell(qName, ret.Messages)
+	}
+	if delete && len(ret.Messages) > num && h.dequeueCountWarning != nil {
+		h.dequeueCountWarning(&DequeueCountError{Requested: num, Returned: len(ret.Messages)})
 	}
 	return ret.Messages, nil
 }
@@ -163,29 +540,185 @@ type deleteReservedReq struct {
 	ReservationID string `json:"reservation_id"`
 }
 
-// DeleteReserved is the client implementation for the IronMQ v3 API (http://dev.iron.io/mq/3/reference/api/#delete-message)
+// DeleteReserved is the client implementation for the IronMQ v3 API (http://dev.iron.io/mq/3/reference/api/#delete-message).
+//
+// If the client was created with WithDeleteRetries, failed deletes are retried. Deleting a message
+// is idempotent, so if a retry finds that the message no longer exists, an earlier attempt must
+// have deleted it and DeleteReserved succeeds with the message the API returned.
+//
+// IronMQ responds with a 403 when the reservation ID is no longer valid because the reservation
+// timed out. DeleteReserved recognizes that from the error message and returns ErrAlreadyRedelivered
 func (h *HTTPClient) DeleteReserved(ctx context.Context, token, projID, qName string, messageID int, reservationID string) (*Deleted, error) {
-	body := &bytes.Buffer{}
-	if err := json.NewEncoder(body).Encode(deleteReservedReq{ReservationID: reservationID}); err != nil {
+	path := fmt.Sprintf("queues/%s/messages/%d", qName, messageID)
+	for attempt := 0; ; attempt++ {
+		ret := new(Deleted)
+		err := h.do(ctx, OpDeleteReserved, "DELETE", token, projID, path, deleteReservedReq{ReservationID: reservationID}, ret)
+		if err == nil {
+			return ret, nil
+		}
+		if httpErr, ok := err.(*HTTPError); ok && attempt > 0 && httpErr.StatusCode == http.StatusNotFound {
+			return &Deleted{Msg: httpErr.Msg}, nil
+		}
+		if isReservationExpired(err) {
+			return nil, ErrAlreadyRedelivered
+		}
+		if attempt >= h.deleteRetries.max || !h.retryable(err) || !SpendRetry(ctx) {
+			return nil, err
+		}
+		if err := h.deleteRetries.wait(ctx, attempt); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// isReservationExpired returns true if err is the API's response to using a reservation ID
+// that timed out
+func isReservationExpired(err error) bool {
+	httpErr, ok := err.(*HTTPError)
+	return ok && httpErr.StatusCode == http.StatusForbidden && strings.Contains(strings.ToLower(httpErr.Msg), "reservation")
+}
+
+type releaseReservedReq struct {
+	ReservationID string `json:"reservation_id"`
+	Delay         int    `json:"delay"`
+}
+
+// ReleaseReserved is the client implementation for the IronMQ v3 API (http://dev.iron.io/mq/3/reference/api/#release-message)
+func (h *HTTPClient) ReleaseReserved(ctx context.Context, token, projID, qName string, messageID int, reservationID string, delay Delay) (*Released, error) {
+	if !delayInRange(delay) {
+		return nil, ErrDelayOutOfRange
+	}
+	reqBody := releaseReservedReq{ReservationID: reservationID, Delay: int(delay)}
+	ret := new(Released)
+	if err := h.do(ctx, OpReleaseReserved, "POST", token, projID, fmt.Sprintf("queues/%s/messages/%d/release", qName, messageID), reqBody, ret); err != nil {
 		return nil, err
 	}
-	req, err := h.newReq("DELETE", token, projID, fmt.Sprintf("queues/%s/messages/%d", qName, messageID), body)
+	return ret, nil
+}
+
+type touchReservedReq struct {
+	ReservationID string `json:"reservation_id"`
+	Timeout       int    `json:"timeout"`
+}
+
+// TouchReserved is the client implementation for the IronMQ v3 API (http://dev.iron.io/mq/3/reference/api/#touch-message)
+func (h *HTTPClient) TouchReserved(ctx context.Context, token, projID, qName string, messageID int, reservationID string, timeout Timeout) (*Touched, error) {
+	if !timeoutInRange(timeout) {
+		return nil, ErrTimeoutOutOfRange
+	}
+	reqBody := touchReservedReq{ReservationID: reservationID, Timeout: int(timeout)}
+	ret := new(Touched)
+	if err := h.do(ctx, OpTouchReserved, "POST", token, projID, fmt.Sprintf("queues/%s/messages/%d/touch", qName, messageID), reqBody, ret); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+type peekResp struct {
+	Messages []Message `json:"messages"`
+}
+
+// Peek is the client implementation for the IronMQ v3 API (http://dev.iron.io/mq/3/reference/api/#peek-messages)
+func (h *HTTPClient) Peek(ctx context.Context, token, projID, qName string, num int) ([]Message, error) {
+	if num > MaxPeek {
+		num = MaxPeek
+	}
+	ret := new(peekResp)
+	err := h.onQueue(ctx, token, projID, qName, func() error {
+		return h.do(ctx, OpPeek, "GET", token, projID, fmt.Sprintf("queues/%s/messages?n=%d", qName, num), nil, ret)
+	})
 	if err != nil {
 		return nil, err
 	}
-	ret := new(Deleted)
-	doFunc := func(resp *http.Response, err error) error {
-		if err != nil {
-			return err
+	return ret.Messages, nil
+}
+
+// MessageExists is the client implementation for the IronMQ v3 API (http://dev.iron.io/mq/3/reference/api/#get-message-by-id).
+// A 404 response means that the message doesn't exist. The response body is read and discarded
+func (h *HTTPClient) MessageExists(ctx context.Context, token, projID, qName string, messageID int) (bool, error) {
+	var ret struct{}
+	err := h.do(ctx, OpGetMessage, "GET", token, projID, fmt.Sprintf("queues/%s/messages/%d", qName, messageID), nil, &ret)
+	if httpErr, ok := err.(*HTTPError); ok && httpErr.StatusCode == http.StatusNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+type queueInfoResp struct {
+	Queue QueueInfo `json:"queue"`
+}
+
+type putQueueReq struct {
+	Queue QueueConfig `json:"queue"`
+}
+
+// PutQueue is the client implementation for the IronMQ v3 API (http://dev.iron.io/mq/3/reference/api/#create-queue)
+func (h *HTTPClient) PutQueue(ctx context.Context, token, projID, qName string, cfg QueueConfig) (*QueueInfo, error) {
+	ret := new(queueInfoResp)
+	if err := h.do(ctx, OpPutQueue, "PUT", token, projID, fmt.Sprintf("queues/%s", qName), putQueueReq{Queue: cfg}, ret); err != nil {
+		return nil, err
+	}
+	return &ret.Queue, nil
+}
+
+// guardPush returns ErrPushQueue if qName is a push queue. The type of each queue is only looked
+// up until it's known. Returns nil if the queue doesn't exist, so that reserving from it fails as
+// usual or creates it, and the error if looking it up failed otherwise
+func (h *HTTPClient) guardPush(ctx context.Context, token, projID, qName string) error {
+	key := qKey(projID, qName)
+	push, ok := h.pushQueues.Load(key)
+	if !ok {
+		ret := new(queueInfoResp)
+		err := h.do(ctx, OpGetQueueInfo, "GET", token, projID, fmt.Sprintf("queues/%s", qName), nil, ret)
+		if isQueueNotFound(err) {
+			return nil
 		}
-		defer resp.Body.Close()
-		if err := json.NewDecoder(resp.Body).Decode(ret); err != nil {
+		if err != nil {
 			return err
 		}
-		return nil
+		push = ret.Queue.IsPush()
+		h.pushQueues.Store(key, push)
+	}
+	if push.(bool) {
+		return ErrPushQueue
+	}
+	return nil
+}
+
+// isQueueNotFound returns true if err is the API's response to an operation on a queue that
+// doesn't exist
+func isQueueNotFound(err error) bool {
+	httpErr, ok := err.(*HTTPError)
+	return ok && httpErr.StatusCode == http.StatusNotFound && strings.Contains(strings.ToLower(httpErr.Msg), "queue")
+}
+
+// onQueue calls f, which operates on qName. If the client was created with WithAutoCreateQueue
+// and f fails because qName doesn't exist, creates qName and calls f once more. If creating the
+// queue fails, returns that error
+func (h *HTTPClient) onQueue(ctx context.Context, token, projID, qName string, f func() error) error {
+	err := f()
+	if h.autoCreateQueue == nil || !isQueueNotFound(err) {
+		return err
+	}
+	if _, err := h.PutQueue(ctx, token, projID, qName, *h.autoCreateQueue); err != nil {
+		return err
 	}
-	if err := gorion.HTTPDo(ctx, h.client, h.transport, req, doFunc); err != nil {
+	return f()
+}
+
+// GetQueueInfo is the client implementation for the IronMQ v3 API (http://dev.iron.io/mq/3/reference/api/#get-queue)
+func (h *HTTPClient) GetQueueInfo(ctx context.Context, token, projID, qName string) (*QueueInfo, error) {
+	ret := new(queueInfoResp)
+	err := h.onQueue(ctx, token, projID, qName, func() error {
+		return h.do(ctx, OpGetQueueInfo, "GET", token, projID, fmt.Sprintf("queues/%s", qName), nil, ret)
+	})
+	if err != nil {
+		if httpErr, ok := err.(*HTTPError); ok && httpErr.StatusCode == http.StatusNotFound {
+			return nil, ErrNoSuchQueue
+		}
 		return nil, err
 	}
-	return ret, nil
+	return &ret.Queue, nil
 }
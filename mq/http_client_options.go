@@ -0,0 +1,216 @@
+package mq
+
+import (
+	"net/http"
+	"time"
+)
+
+// HTTPClientOption configures optional behavior of an HTTPClient. Pass any number of them
+// to NewHTTPClient
+type HTTPClientOption func(*HTTPClient)
+
+// WithMetricsRecorder makes the HTTPClient report its measurements to r
+func WithMetricsRecorder(r MetricsRecorder) HTTPClientOption {
+	return func(h *HTTPClient) {
+		h.metrics = r
+	}
+}
+
+// WithDeleteRetries makes the HTTPClient retry DeleteReserved up to retries times when it fails
+// with a connection error or a 5xx or 429 response. The first retry happens after backoff, and
+// the wait doubles before each retry after that. Retries are also limited by the retry budget
+// in the request context, if there is one (see WithRetryBudget)
+func WithDeleteRetries(retries int, backoff time.Duration) HTTPClientOption {
+	return func(h *HTTPClient) {
+		h.deleteRetries = retryPolicy{max: retries, backoff: backoff}
+	}
+}
+
+// WithRetryableMsg makes the HTTPClient also retry requests that failed with an error response
+// for which retryable returns true, given the status code and message of the response. This is
+// for responses such as "queue is being modified" that are transient even though their status
+// code doesn't say so. Connection errors and 5xx and 429 responses are always retried. It only
+// has an effect on requests that are retried at all, like DeleteReserved with WithDeleteRetries
+func WithRetryableMsg(retryable func(status int, msg string) bool) HTTPClientOption {
+	return func(h *HTTPClient) {
+		h.retryableMsg = retryable
+	}
+}
+
+// WithMaxConnsPerHost limits the HTTPClient to at most n simultaneous connections to the IronMQ
+// host, counting connections that are in use, being dialed or idle. A request that needs a
+// connection while n are in use blocks until one frees up or its context is done. n <= 0 means
+// no limit, which is the default.
+//
+// This is separate from the pool of idle connections the client keeps around for reuse. That
+// pool uses the net/http defaults, so with a high n many of the connections opened during a
+// burst are closed once the burst ends rather than being kept idle. It has no effect on clients
+// created with WithRoundTripper
+func WithMaxConnsPerHost(n int) HTTPClientOption {
+	return func(h *HTTPClient) {
+		h.transport.MaxConnsPerHost = n
+	}
+}
+
+// WithTracePropagation makes the HTTPClient call inject with each message's push headers before
+// enqueueing it, so that the trace context of the span that's active in the Enqueue context is
+// forwarded along with the message. IronMQ sends push headers to push queue subscribers as HTTP
+// headers, so subscribers can join the trace. Use TraceHeaders on the consuming side of pull
+// queues. The push headers in the messages passed to Enqueue aren't modified
+func WithTracePropagation(inject TraceInjector) HTTPClientOption {
+	return func(h *HTTPClient) {
+		h.traceInjector = inject
+	}
+}
+
+// WithConnTrace makes the HTTPClient trace how each request gets its connection with
+// net/http/httptrace, and report whether the connection was reused to the metrics recorder's
+// ObserveConn. It's off by default to avoid the overhead of tracing every request
+func WithConnTrace() HTTPClientOption {
+	return func(h *HTTPClient) {
+		h.connTrace = true
+	}
+}
+
+// WithPushQueueGuard makes Dequeue return ErrPushQueue instead of reserving messages from push
+// queues (see QueueInfo.IsPush), since reserving from a push queue is usually a misconfiguration.
+// To tell, the first Dequeue from each queue gets the queue's info first, and the result is kept
+// for the lifetime of the client, so a queue whose type changes later needs a new client
+func WithPushQueueGuard() HTTPClientOption {
+	return func(h *HTTPClient) {
+		h.pushGuard = true
+	}
+}
+
+// WithDwellTime makes the HTTPClient stamp every message it enqueues with a HeaderEnqueuedAt push
+// header, and report how long every message it reserves with that header was waiting in the
+// queue to the metrics recorder's ObserveDwell. Both times are taken on the server's clock as
+// estimated by ServerTime, so that clock skew between the producing and consuming hosts doesn't
+// distort the measurement. Dwell times can only be measured if the consumer's server returns push
+// headers along with reserved messages, and are accurate to about a second
+func WithDwellTime() HTTPClientOption {
+	return func(h *HTTPClient) {
+		h.dwellTime = true
+	}
+}
+
+// WithMaxResponseBytes makes the HTTPClient fail requests whose successful responses have a body
+// of more than n bytes with a *ResponseTooLargeError, instead of reading the entire body into
+// memory. The limit is enforced while reading, so it also applies to responses with chunked
+// transfer encoding, which don't say how long they are up front. n <= 0 means no limit, which is
+// the default. Bodies of error responses are always cut off after a few kilobytes
+func WithMaxResponseBytes(n int64) HTTPClientOption {
+	return func(h *HTTPClient) {
+		h.maxResponseBytes = n
+	}
+}
+
+// WithMessageURLs makes the HTTPClient return the URL of each message it enqueues in
+// Enqueued.URLs, which is https://{host}:{port}/3/projects/{project}/queues/{queue}/messages/{id}
+// with the client's scheme, host and port
+func WithMessageURLs() HTTPClientOption {
+	return func(h *HTTPClient) {
+		h.messageURLs = true
+	}
+}
+
+// WithRoundTripper makes the HTTPClient send its requests with rt instead of its own
+// http.Transport, so that tests can fail, delay or answer requests without a server. Each
+// request's context is the context passed to the Client method, and rt must stop and return an
+// error once it's done, like http.Transport does, for the method to return when its context is
+// done
+func WithRoundTripper(rt http.RoundTripper) HTTPClientOption {
+	return func(h *HTTPClient) {
+		h.client.Transport = rt
+	}
+}
+
+// WithDequeueCountWarning makes the HTTPClient call warn whenever Dequeue with delete set to true
+// gets more messages back than it requested, which means the API's reserve-and-delete misbehaved.
+// Dequeue still returns all the messages, which were already deleted, without an error. warn is
+// called before Dequeue returns, so it shouldn't block
+func WithDequeueCountWarning(warn func(*DequeueCountError)) HTTPClientOption {
+	return func(h *HTTPClient) {
+		h.dequeueCountWarning = warn
+	}
+}
+
+// WithSuccessStatuses makes the HTTPClient treat responses with any of the given status codes as
+// successful, in addition to all 2xx responses, which are always successful. This is for gateways
+// in front of IronMQ that respond with non-standard status codes. Responses with one of these
+// codes may also have an empty body, in which case the result of the call has its zero value
+func WithSuccessStatuses(codes ...int) HTTPClientOption {
+	return func(h *HTTPClient) {
+		if h.successStatuses == nil {
+			h.successStatuses = make(map[int]bool, len(codes))
+		}
+		for _, code := range codes {
+			h.successStatuses[code] = true
+		}
+	}
+}
+
+// WithTokenInQuery makes the HTTPClient send the token in the oauth query parameter of each
+// request instead of in the Authorization header. Some endpoints, such as the webhook endpoint,
+// and some proxies only accept the token that way. The token is query-escaped along with any
+// other query parameters the request already has. The token is redacted from the URLs in the
+// *url.Errors that failed requests return
+func WithTokenInQuery() HTTPClientOption {
+	return func(h *HTTPClient) {
+		h.tokenInQuery = true
+	}
+}
+
+// WithMaxBatchBytes makes the HTTPClient split the messages passed to Enqueue into requests whose
+// messages add up to at most n bytes, as well as at most MaxEnqueueBatch messages. Each message
+// counts with its body, the keys and values of its push headers and EnqueueMsgOverheadBytes, like
+// in SuggestBatchSize, so a batch of SuggestBatchSize messages fits in one request. The
+// default is MaxEnqueueBatchBytes, which is IronMQ's limit, so only use this to lower the budget,
+// for example for a proxy with a smaller request size limit. Values less than 1 are ignored
+func WithMaxBatchBytes(n int) HTTPClientOption {
+	return func(h *HTTPClient) {
+		if n > 0 {
+			h.maxBatchBytes = n
+		}
+	}
+}
+
+// WithBodyCodec makes the HTTPClient encode the body of every message it enqueues with codec,
+// followed by base64 so that the body stays valid text, and name the codec in the message's
+// HeaderBodyCodec push header. Consumers decode the bodies with DecodeBody, which ConsumeTyped
+// does automatically. Pass GzipCodec{} unless you have a reason to choose another codec, since
+// every consumer can decode gzip without being configured for it.
+//
+// Compressing small bodies usually makes them bigger, so this is only worth it for queues whose
+// messages are big. The push headers in the messages passed to Enqueue aren't modified
+func WithBodyCodec(codec BodyCodec) HTTPClientOption {
+	return func(h *HTTPClient) {
+		h.bodyCodec = codec
+	}
+}
+
+// WithStreamingEncode makes the HTTPClient encode the JSON of each enqueue request while it's
+// being sent, instead of encoding all of it into memory first. This lowers the peak memory use
+// of enqueueing big batches of big messages.
+//
+// The request body is sent with chunked transfer encoding and can only be read once, which has
+// some consequences. net/http can't transparently resend a request whose body was partially
+// sent when a reused connection turns out to be broken, so those requests fail instead. If the
+// client is ever made to retry enqueues, the whole body would have to be encoded again. Some
+// proxies also don't accept chunked requests. Other requests are small and always buffered
+func WithStreamingEncode() HTTPClientOption {
+	return func(h *HTTPClient) {
+		h.streamingEncode = true
+	}
+}
+
+// WithAutoCreateQueue makes the HTTPClient create queues with cfg when they don't exist. When
+// Enqueue, Dequeue, Peek or GetQueueInfo fail because the queue wasn't found, the client creates
+// it with PutQueue and retries the operation once. If creating the queue fails, the operation
+// returns that error without retrying. This is for dynamically named queues, such as one per
+// tenant, that can't all be created upfront
+func WithAutoCreateQueue(cfg QueueConfig) HTTPClientOption {
+	return func(h *HTTPClient) {
+		h.autoCreateQueue = &cfg
+	}
+}
@@ -0,0 +1,90 @@
+package mq
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+	"github.com/arschles/testsrv"
+	"golang.org/x/net/context"
+)
+
+func TestWithMaxConnsPerHost(t *testing.T) {
+	cl := NewHTTPClient(SchemeHTTP, "localhost", 8080, WithMaxConnsPerHost(3))
+	assert.Equal(t, cl.transport.MaxConnsPerHost, 3, "max conns per host")
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+func TestWithRoundTripper(t *testing.T) {
+	var gotURL string
+	rt := roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		gotURL = r.URL.String()
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": []string{"application/json"}},
+			Body:       ioutil.NopCloser(strings.NewReader(`{"messages":[{"id":1,"body":"abc"}]}`)),
+			Request:    r,
+		}, nil
+	})
+	cl := NewHTTPClient(SchemeHTTP, "localhost", 8080, WithRoundTripper(rt))
+	msgs, err := cl.Peek(bgCtx, token, projID, qName, 5)
+	assert.NoErr(t, err)
+	assert.Equal(t, gotURL, "http://localhost:8080/3/projects/"+projID+"/queues/"+qName+"/messages?n=5", "request URL")
+	assert.Equal(t, len(msgs), 1, "number of messages")
+	assert.Equal(t, msgs[0].Body, "abc", "message body")
+}
+
+func TestWithRoundTripperCancel(t *testing.T) {
+	rt := roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		<-r.Context().Done()
+		return nil, r.Context().Err()
+	})
+	cl := NewHTTPClient(SchemeHTTP, "localhost", 8080, WithRoundTripper(rt))
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := cl.Peek(ctx, token, projID, qName, 5)
+	assert.Err(t, context.DeadlineExceeded, err)
+}
+
+func TestWithTokenInQueryRedactsErrors(t *testing.T) {
+	const secret = "SECRETTOKEN"
+	rt := roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		return nil, errors.New("connection refused")
+	})
+	cl := NewHTTPClient(SchemeHTTP, "localhost", 8080, WithTokenInQuery(), WithRoundTripper(rt))
+	_, err := cl.Peek(bgCtx, secret, projID, qName, 1)
+	urlErr, ok := err.(*url.Error)
+	assert.True(t, ok, "returned error was a %T, not a *url.Error", err)
+	assert.False(t, strings.Contains(err.Error(), secret), "error [%s] contained the token", err)
+	assert.True(t, strings.Contains(urlErr.URL, "oauth="+redactedToken), "URL [%s] had no redacted token", urlErr.URL)
+	assert.True(t, retryable(err), "redacted error wasn't retryable")
+}
+
+func TestWithTokenInQuery(t *testing.T) {
+	const specialToken = "a+b/c d"
+	type reqInfo struct {
+		authHeader string
+		query      url.Values
+	}
+	reqs := make(chan reqInfo, 1)
+	srv := testsrv.StartServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqs <- reqInfo{authHeader: r.Header.Get("Authorization"), query: r.URL.Query()}
+		w.Write([]byte(`{"messages":[]}`))
+	}))
+	defer srv.Close()
+	cl := newTestHTTPClient(t, srv, WithTokenInQuery())
+	_, err := cl.Peek(bgCtx, specialToken, projID, qName, 5)
+	assert.NoErr(t, err)
+	req := <-reqs
+	assert.Equal(t, req.authHeader, "", "Authorization header")
+	assert.Equal(t, req.query.Get("oauth"), specialToken, "oauth query parameter")
+	assert.Equal(t, req.query.Get("n"), "5", "n query parameter")
+}
@@ -2,11 +2,17 @@ package mq
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/arschles/assert"
 	"golang.org/x/net/context"
@@ -98,7 +104,10 @@ func (q *qServer) deleteReservedHandler() http.Handler {
 			return
 		}
 		ret, err := q.mem.DeleteReserved(bgCtx, token, projID, qName, msgID, req.ReservationID)
-		if err != nil {
+		if err == ErrAlreadyRedelivered {
+			http.Error(w, `{"msg":"Reservation has timed out"}`, http.StatusForbidden)
+			return
+		} else if err != nil {
 			http.Error(w, fmt.Sprintf("error deleting reserved msg [%s]", err), http.StatusInternalServerError)
 			return
 		}
@@ -109,6 +118,167 @@ func (q *qServer) deleteReservedHandler() http.Handler {
 	})
 }
 
+func (q *qServer) releaseReservedHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		qName, ok := mux.Vars(r)["queue_name"]
+		if !ok {
+			http.Error(w, "missing queue name", http.StatusBadRequest)
+			return
+		}
+		msgID, err := strconv.Atoi(mux.Vars(r)["message_id"])
+		if err != nil {
+			http.Error(w, "message ID must be an int", http.StatusBadRequest)
+			return
+		}
+		defer r.Body.Close()
+		req := new(releaseReservedReq)
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			http.Error(w, fmt.Sprintf("invalid json [%s]", err), http.StatusBadRequest)
+			return
+		}
+		ret, err := q.mem.ReleaseReserved(bgCtx, token, projID, qName, msgID, req.ReservationID, Delay(req.Delay))
+		if err == ErrNoSuchReservation {
+			http.Error(w, `{"msg":"Reservation not found"}`, http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, fmt.Sprintf("error releasing reserved msg [%s]", err), http.StatusInternalServerError)
+			return
+		}
+		if err := json.NewEncoder(w).Encode(ret); err != nil {
+			http.Error(w, fmt.Sprintf("error encoding response json [%s]", err), http.StatusInternalServerError)
+			return
+		}
+	})
+}
+
+func (q *qServer) touchReservedHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		qName, ok := mux.Vars(r)["queue_name"]
+		if !ok {
+			http.Error(w, "missing queue name", http.StatusBadRequest)
+			return
+		}
+		msgID, err := strconv.Atoi(mux.Vars(r)["message_id"])
+		if err != nil {
+			http.Error(w, "message ID must be an int", http.StatusBadRequest)
+			return
+		}
+		defer r.Body.Close()
+		req := new(touchReservedReq)
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			http.Error(w, fmt.Sprintf("invalid json [%s]", err), http.StatusBadRequest)
+			return
+		}
+		ret, err := q.mem.TouchReserved(bgCtx, token, projID, qName, msgID, req.ReservationID, Timeout(req.Timeout))
+		if err == ErrNoSuchReservation {
+			http.Error(w, `{"msg":"Reservation not found"}`, http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, fmt.Sprintf("error touching reserved msg [%s]", err), http.StatusInternalServerError)
+			return
+		}
+		if err := json.NewEncoder(w).Encode(ret); err != nil {
+			http.Error(w, fmt.Sprintf("error encoding response json [%s]", err), http.StatusInternalServerError)
+			return
+		}
+	})
+}
+
+func (q *qServer) getMessageHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		qName, ok := mux.Vars(r)["queue_name"]
+		if !ok {
+			http.Error(w, "missing queue name", http.StatusBadRequest)
+			return
+		}
+		msgID, err := strconv.Atoi(mux.Vars(r)["message_id"])
+		if err != nil {
+			http.Error(w, "message ID must be an int", http.StatusBadRequest)
+			return
+		}
+		exists, err := q.mem.MessageExists(bgCtx, token, projID, qName, msgID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("error getting msg [%s]", err), http.StatusInternalServerError)
+			return
+		} else if !exists {
+			http.Error(w, `{"msg":"Message not found"}`, http.StatusNotFound)
+			return
+		}
+		fmt.Fprintf(w, `{"message":{"id":"%d"}}`, msgID)
+	})
+}
+
+func (q *qServer) peekHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		qName, ok := mux.Vars(r)["queue_name"]
+		if !ok {
+			http.Error(w, "missing queue name", http.StatusBadRequest)
+			return
+		}
+		num, err := strconv.Atoi(r.URL.Query().Get("n"))
+		if err != nil {
+			http.Error(w, "n must be an int", http.StatusBadRequest)
+			return
+		}
+		msgs, err := q.mem.Peek(bgCtx, token, projID, qName, num)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("peek error [%s]", err), http.StatusInternalServerError)
+			return
+		}
+		if err := json.NewEncoder(w).Encode(peekResp{Messages: msgs}); err != nil {
+			http.Error(w, fmt.Sprintf("error encoding peek response json [%s]", err), http.StatusInternalServerError)
+			return
+		}
+	})
+}
+
+func (q *qServer) putQueueHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		qName, ok := mux.Vars(r)["queue_name"]
+		if !ok {
+			http.Error(w, "missing queue name", http.StatusBadRequest)
+			return
+		}
+		defer r.Body.Close()
+		req := new(putQueueReq)
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			http.Error(w, fmt.Sprintf("invalid json [%s]", err), http.StatusBadRequest)
+			return
+		}
+		info, err := q.mem.PutQueue(bgCtx, token, projID, qName, req.Queue)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("error putting queue [%s]", err), http.StatusInternalServerError)
+			return
+		}
+		if err := json.NewEncoder(w).Encode(queueInfoResp{Queue: *info}); err != nil {
+			http.Error(w, fmt.Sprintf("error encoding response json [%s]", err), http.StatusInternalServerError)
+			return
+		}
+	})
+}
+
+func (q *qServer) getQueueInfoHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		qName, ok := mux.Vars(r)["queue_name"]
+		if !ok {
+			http.Error(w, "missing queue name", http.StatusBadRequest)
+			return
+		}
+		info, err := q.mem.GetQueueInfo(bgCtx, token, projID, qName)
+		if err == ErrNoSuchQueue {
+			http.Error(w, `{"msg":"Queue not found"}`, http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, fmt.Sprintf("error getting queue info [%s]", err), http.StatusInternalServerError)
+			return
+		}
+		if err := json.NewEncoder(w).Encode(queueInfoResp{Queue: *info}); err != nil {
+			http.Error(w, fmt.Sprintf("error encoding response json [%s]", err), http.StatusInternalServerError)
+			return
+		}
+	})
+}
+
 func makeQHandler() http.Handler {
 	srv := &qServer{mem: NewMemClient()}
 	r := mux.NewRouter()
@@ -116,14 +286,19 @@ func makeQHandler() http.Handler {
 		http.Error(w, fmt.Sprintf(`{"msg":"path %s not found"`, r.URL), http.StatusNotFound)
 	})
 	r.Handle("/3/projects/{project_id}/queues/{queue_name}/messages", srv.enqueueHandler()).Methods("POST")
+	r.Handle("/3/projects/{project_id}/queues/{queue_name}/messages", srv.peekHandler()).Methods("GET")
 	r.Handle("/3/projects/{project_id}/queues/{queue_name}/reservations", srv.dequeueHandler()).Methods("POST")
 	r.Handle("/3/projects/{project_id}/queues/{queue_name}/messages/{message_id}", srv.deleteReservedHandler()).Methods("DELETE")
+	r.Handle("/3/projects/{project_id}/queues/{queue_name}/messages/{message_id}", srv.getMessageHandler()).Methods("GET")
+	r.Handle("/3/projects/{project_id}/queues/{queue_name}/messages/{message_id}/release", srv.releaseReservedHandler()).Methods("POST")
+	r.Handle("/3/projects/{project_id}/queues/{queue_name}/messages/{message_id}/touch", srv.touchReservedHandler()).Methods("POST")
+	r.Handle("/3/projects/{project_id}/queues/{queue_name}", srv.getQueueInfoHandler()).Methods("GET")
+	r.Handle("/3/projects/{project_id}/queues/{queue_name}", srv.putQueueHandler()).Methods("PUT")
 	return r
 }
 
-func TestHTTPQueueOperations(t *testing.T) {
-	srv := testsrv.StartServer(makeQHandler())
-	defer srv.Close()
+// newTestHTTPClient returns an HTTPClient configured with opts that talks to srv
+func newTestHTTPClient(t *testing.T, srv *testsrv.Server, opts ...HTTPClientOption) *HTTPClient {
 	urlStrSplit := strings.Split(strings.TrimPrefix(srv.URLStr(), "http://"), ":")
 	assert.Equal(t, 2, len(urlStrSplit), "number of elements in the URL string")
 	host := urlStrSplit[0]
@@ -132,6 +307,578 @@ func TestHTTPQueueOperations(t *testing.T) {
 	if port > 65535 {
 		t.Fatalf("port [%d] not a uint16", port)
 	}
-	cl := NewHTTPClient(SchemeHTTP, host, uint16(port))
+	return NewHTTPClient(SchemeHTTP, host, uint16(port), opts...)
+}
+
+func TestHTTPQueueOperations(t *testing.T) {
+	srv := testsrv.StartServer(makeQHandler())
+	defer srv.Close()
+	cl := newTestHTTPClient(t, srv)
 	assert.NoErr(t, qOperations(cl))
 }
+
+type reservedMetrics struct {
+	NopMetrics
+	num         int
+	bytes       int
+	redelivered int
+}
+
+func (r *reservedMetrics) ObserveReserved(qName string, num, bytes int) {
+	r.num += num
+	r.bytes += bytes
+}
+
+func (r *reservedMetrics) ObserveRedelivered(qName string, num int) {
+	r.redelivered += num
+}
+
+func TestHTTPDeleteAfterRedelivery(t *testing.T) {
+	srv := testsrv.StartServer(makeQHandler())
+	defer srv.Close()
+	assert.NoErr(t, deleteAfterRedelivery(newTestHTTPClient(t, srv)))
+}
+
+func TestHTTPMessageExists(t *testing.T) {
+	srv := testsrv.StartServer(makeQHandler())
+	defer srv.Close()
+	assert.NoErr(t, messageExists(newTestHTTPClient(t, srv)))
+}
+
+func TestHTTPDequeueMetrics(t *testing.T) {
+	srv := testsrv.StartServer(makeQHandler())
+	defer srv.Close()
+	metrics := new(reservedMetrics)
+	cl := newTestHTTPClient(t, srv, WithMetricsRecorder(metrics))
+	msgs := []NewMessage{
+		{Body: "abc", PushHeaders: make(map[string]string)},
+		{Body: "defgh", PushHeaders: make(map[string]string)},
+	}
+	_, err := cl.Enqueue(bgCtx, token, projID, qName, msgs)
+	assert.NoErr(t, err)
+	dqMsgs, err := cl.Dequeue(bgCtx, token, projID, qName, 2, Timeout(30), Wait(1), false)
+	assert.NoErr(t, err)
+	assert.Equal(t, len(dqMsgs), 2, "number of dequeued messages")
+	assert.Equal(t, metrics.num, 2, "number of reserved messages")
+	assert.Equal(t, metrics.bytes, 8, "number of reserved bytes")
+	assert.Equal(t, metrics.redelivered, 0, "number of redelivered messages")
+	_, err = cl.ReleaseReserved(bgCtx, token, projID, qName, dqMsgs[0].ID, dqMsgs[0].ReservationID, 0)
+	assert.NoErr(t, err)
+	dqMsgs, err = cl.Dequeue(bgCtx, token, projID, qName, 2, Timeout(30), Wait(1), false)
+	assert.NoErr(t, err)
+	assert.Equal(t, len(dqMsgs), 1, "number of dequeued messages")
+	assert.True(t, dqMsgs[0].IsRedelivery(), "released message wasn't a redelivery")
+	assert.Equal(t, metrics.redelivered, 1, "number of redelivered messages")
+}
+
+type connMetrics struct {
+	NopMetrics
+	mtx    sync.Mutex
+	reused []bool
+}
+
+func (c *connMetrics) ObserveConn(op string, reused bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.reused = append(c.reused, reused)
+}
+
+func TestHTTPConnTrace(t *testing.T) {
+	srv := testsrv.StartServer(makeQHandler())
+	defer srv.Close()
+	metrics := new(connMetrics)
+	cl := newTestHTTPClient(t, srv, WithMetricsRecorder(metrics), WithConnTrace())
+	for i := 0; i < 2; i++ {
+		_, err := cl.Enqueue(bgCtx, token, projID, qName, []NewMessage{{Body: "abc", PushHeaders: make(map[string]string)}})
+		assert.NoErr(t, err)
+	}
+	metrics.mtx.Lock()
+	defer metrics.mtx.Unlock()
+	assert.Equal(t, len(metrics.reused), 2, "number of observed connections")
+	assert.False(t, metrics.reused[0], "first request reused a connection")
+	assert.True(t, metrics.reused[1], "second request didn't reuse the connection")
+}
+
+func TestQueueInfoIsPush(t *testing.T) {
+	assert.False(t, QueueInfo{Type: QueueTypePull}.IsPush(), "pull queue was a push queue")
+	assert.False(t, QueueInfo{}.IsPush(), "queue without a type was a push queue")
+	assert.True(t, QueueInfo{Type: QueueTypeMulticast}.IsPush(), "multicast queue wasn't a push queue")
+	assert.True(t, QueueInfo{Type: QueueTypeUnicast}.IsPush(), "unicast queue wasn't a push queue")
+	withSubscribers := QueueInfo{Push: &PushInfo{Subscribers: []Subscriber{{Name: "s", URL: "http://example.com"}}}}
+	assert.True(t, withSubscribers.IsPush(), "queue with subscribers wasn't a push queue")
+}
+
+func TestHTTPPushQueueGuard(t *testing.T) {
+	srv := testsrv.StartServer(makeQHandler())
+	defer srv.Close()
+	cl := newTestHTTPClient(t, srv, WithPushQueueGuard())
+	// queues that don't exist yet aren't guarded
+	_, err := cl.Dequeue(bgCtx, token, projID, "nonexistent", 1, Timeout(30), Wait(0), false)
+	assert.False(t, err == ErrPushQueue, "nonexistent queue was guarded as a push queue")
+	_, err = cl.PutQueue(bgCtx, token, projID, qName, QueueConfig{Type: QueueTypeMulticast})
+	assert.NoErr(t, err)
+	info, err := cl.GetQueueInfo(bgCtx, token, projID, qName)
+	assert.NoErr(t, err)
+	assert.True(t, info.IsPush(), "queue created as multicast wasn't a push queue")
+	_, err = cl.Dequeue(bgCtx, token, projID, qName, 1, Timeout(30), Wait(0), false)
+	assert.Err(t, ErrPushQueue, err)
+	_, err = newTestHTTPClient(t, srv).Dequeue(bgCtx, token, projID, qName, 1, Timeout(30), Wait(0), false)
+	assert.NoErr(t, err)
+
+	_, err = cl.PutQueue(bgCtx, token, projID, "pull-queue", QueueConfig{Type: QueueTypePull})
+	assert.NoErr(t, err)
+	_, err = cl.Dequeue(bgCtx, token, projID, "pull-queue", 1, Timeout(30), Wait(0), false)
+	assert.NoErr(t, err)
+}
+
+func TestHTTPServerTime(t *testing.T) {
+	srv := testsrv.StartServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Date", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+		w.Write([]byte(`{"queue":{"name":"q"}}`))
+	}))
+	defer srv.Close()
+	cl := newTestHTTPClient(t, srv)
+	assert.True(t, time.Since(cl.ServerTime()) < time.Second, "server time before the first response was off by [%s]", time.Since(cl.ServerTime()))
+	_, err := cl.GetQueueInfo(bgCtx, token, projID, qName)
+	assert.NoErr(t, err)
+	skew := cl.ServerTime().Sub(time.Now().Add(time.Hour))
+	assert.True(t, skew > -time.Second && skew < time.Second, "server time was off by [%s]", skew)
+}
+
+type dwellMetrics struct {
+	NopMetrics
+	dwells []time.Duration
+}
+
+func (d *dwellMetrics) ObserveDwell(qName string, dur time.Duration) {
+	d.dwells = append(d.dwells, dur)
+}
+
+func TestHTTPDwellTime(t *testing.T) {
+	srv := testsrv.StartServer(makeQHandler())
+	defer srv.Close()
+	metrics := new(dwellMetrics)
+	cl := newTestHTTPClient(t, srv, WithMetricsRecorder(metrics), WithDwellTime())
+	headers := map[string]string{"a": "b"}
+	_, err := cl.Enqueue(bgCtx, token, projID, qName, []NewMessage{{Body: "abc", PushHeaders: headers}})
+	assert.NoErr(t, err)
+	assert.Equal(t, len(headers), 1, "number of push headers of the enqueued message")
+	msgs, err := cl.Dequeue(bgCtx, token, projID, qName, 1, Timeout(30), Wait(0), false)
+	assert.NoErr(t, err)
+	assert.Equal(t, len(msgs), 1, "number of dequeued messages")
+	_, ok := EnqueuedAt(msgs[0])
+	assert.True(t, ok, "dequeued message had no enqueue time")
+	assert.Equal(t, len(metrics.dwells), 1, "number of dwell times")
+	assert.True(t, metrics.dwells[0] >= 0 && metrics.dwells[0] < 2*time.Second, "dwell time [%s] out of range", metrics.dwells[0])
+}
+
+// chunkedHandler writes resp in small pieces, flushing after each one, so that it's sent with
+// chunked transfer encoding and no Content-Length
+func chunkedHandler(resp string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		for rest := resp; len(rest) > 0; {
+			n := 16
+			if n > len(rest) {
+				n = len(rest)
+			}
+			fmt.Fprint(w, rest[:n])
+			w.(http.Flusher).Flush()
+			rest = rest[n:]
+		}
+	})
+}
+
+func TestHTTPChunkedResponse(t *testing.T) {
+	resp := `{"messages":[{"id":1,"body":"` + strings.Repeat("a", 200) + `","reserved_count":1,"reservation_id":"r1"}]}`
+	srv := testsrv.StartServer(chunkedHandler(resp))
+	defer srv.Close()
+	msgs, err := newTestHTTPClient(t, srv).Dequeue(bgCtx, token, projID, qName, 1, Timeout(30), Wait(0), false)
+	assert.NoErr(t, err)
+	assert.Equal(t, len(msgs), 1, "number of dequeued messages")
+	assert.Equal(t, msgs[0].Body, strings.Repeat("a", 200), "message body")
+
+	msgs, err = newTestHTTPClient(t, srv, WithMaxResponseBytes(int64(len(resp)))).Dequeue(bgCtx, token, projID, qName, 1, Timeout(30), Wait(0), false)
+	assert.NoErr(t, err)
+	assert.Equal(t, len(msgs), 1, "number of dequeued messages at the limit")
+
+	_, err = newTestHTTPClient(t, srv, WithMaxResponseBytes(100)).Dequeue(bgCtx, token, projID, qName, 1, Timeout(30), Wait(0), false)
+	tooLarge, ok := err.(*ResponseTooLargeError)
+	assert.True(t, ok, "returned error [%v] was not a *ResponseTooLargeError", err)
+	assert.Equal(t, tooLarge.Limit, int64(100), "limit")
+}
+
+func TestHTTPMessageURLs(t *testing.T) {
+	srv := testsrv.StartServer(makeQHandler())
+	defer srv.Close()
+	msgs := []NewMessage{
+		{Body: "abc", PushHeaders: make(map[string]string)},
+		{Body: "def", PushHeaders: make(map[string]string)},
+	}
+	enq, err := newTestHTTPClient(t, srv).Enqueue(bgCtx, token, projID, qName, msgs)
+	assert.NoErr(t, err)
+	assert.Equal(t, len(enq.URLs), 0, "number of URLs without WithMessageURLs")
+
+	cl := newTestHTTPClient(t, srv, WithMessageURLs(), WithTokenInQuery())
+	enq, err = cl.Enqueue(bgCtx, token, projID, qName, msgs)
+	assert.NoErr(t, err)
+	assert.Equal(t, len(enq.URLs), len(enq.IDs), "number of URLs")
+	for i, u := range enq.URLs {
+		want := fmt.Sprintf("%s/3/projects/%s/queues/%s/messages/%s", srv.URLStr(), projID, qName, enq.IDs[i])
+		assert.Equal(t, u, want, "message URL")
+		assert.False(t, strings.Contains(u, token), "message URL [%s] contained the token", u)
+	}
+}
+
+func TestHTTPGetQueueInfo(t *testing.T) {
+	srv := testsrv.StartServer(makeQHandler())
+	defer srv.Close()
+	cl := newTestHTTPClient(t, srv)
+	_, err := cl.GetQueueInfo(bgCtx, token, projID, qName)
+	assert.Err(t, ErrNoSuchQueue, err)
+	_, err = cl.Enqueue(bgCtx, token, projID, qName, []NewMessage{{Body: "abc", PushHeaders: make(map[string]string)}})
+	assert.NoErr(t, err)
+	info, err := cl.GetQueueInfo(bgCtx, token, projID, qName)
+	assert.NoErr(t, err)
+	assert.Equal(t, info.Name, qName, "queue name")
+	assert.Equal(t, info.Size, 1, "queue size")
+	assert.Equal(t, info.TotalMessages, 1, "total messages")
+}
+
+func TestHTTPReleaseReserved(t *testing.T) {
+	srv := testsrv.StartServer(makeQHandler())
+	defer srv.Close()
+	cl := newTestHTTPClient(t, srv)
+	_, err := cl.Enqueue(bgCtx, token, projID, qName, []NewMessage{{Body: "abc", PushHeaders: make(map[string]string)}})
+	assert.NoErr(t, err)
+	msgs, err := cl.Dequeue(bgCtx, token, projID, qName, 1, Timeout(30), Wait(1), false)
+	assert.NoErr(t, err)
+	assert.Equal(t, len(msgs), 1, "number of dequeued messages")
+	_, err = cl.ReleaseReserved(bgCtx, token, projID, qName, msgs[0].ID, msgs[0].ReservationID, MaxDelay+1)
+	assert.Err(t, ErrDelayOutOfRange, err)
+	released, err := cl.ReleaseReserved(bgCtx, token, projID, qName, msgs[0].ID, msgs[0].ReservationID, 0)
+	assert.NoErr(t, err)
+	assert.True(t, len(released.Msg) > 0, "released message was empty")
+	msgs, err = cl.Dequeue(bgCtx, token, projID, qName, 1, Timeout(30), Wait(1), false)
+	assert.NoErr(t, err)
+	assert.Equal(t, len(msgs), 1, "number of dequeued messages")
+	assert.Equal(t, msgs[0].ReservedCount, 2, "reserved count")
+}
+
+func TestHTTPTouchReserved(t *testing.T) {
+	srv := testsrv.StartServer(makeQHandler())
+	defer srv.Close()
+	cl := newTestHTTPClient(t, srv)
+	_, err := cl.Enqueue(bgCtx, token, projID, qName, []NewMessage{{Body: "abc", PushHeaders: make(map[string]string)}})
+	assert.NoErr(t, err)
+	msgs, err := cl.Dequeue(bgCtx, token, projID, qName, 1, Timeout(30), Wait(1), false)
+	assert.NoErr(t, err)
+	assert.Equal(t, len(msgs), 1, "number of dequeued messages")
+	_, err = cl.TouchReserved(bgCtx, token, projID, qName, msgs[0].ID, msgs[0].ReservationID, Timeout(0))
+	assert.Err(t, ErrTimeoutOutOfRange, err)
+	touched, err := cl.TouchReserved(bgCtx, token, projID, qName, msgs[0].ID, msgs[0].ReservationID, Timeout(30))
+	assert.NoErr(t, err)
+	assert.True(t, touched.ReservationID != msgs[0].ReservationID, "reservation ID didn't change")
+	_, err = cl.DeleteReserved(bgCtx, token, projID, qName, msgs[0].ID, msgs[0].ReservationID)
+	assert.True(t, err != nil, "deleting with the old reservation ID succeeded")
+	_, err = cl.DeleteReserved(bgCtx, token, projID, qName, msgs[0].ID, touched.ReservationID)
+	assert.NoErr(t, err)
+}
+
+func TestHTTPPeek(t *testing.T) {
+	srv := testsrv.StartServer(makeQHandler())
+	defer srv.Close()
+	cl := newTestHTTPClient(t, srv)
+	enq, err := cl.Enqueue(bgCtx, token, projID, qName, []NewMessage{
+		{Body: "abc", PushHeaders: make(map[string]string)},
+		{Body: "def", PushHeaders: make(map[string]string)},
+	})
+	assert.NoErr(t, err)
+	msgs, err := cl.Peek(bgCtx, token, projID, qName, 1)
+	assert.NoErr(t, err)
+	assert.Equal(t, len(msgs), 1, "number of peeked messages")
+	assert.Equal(t, strconv.Itoa(msgs[0].ID), enq.IDs[0], "peeked message ID")
+	assert.Equal(t, msgs[0].Body, "abc", "peeked message body")
+	info, err := cl.GetQueueInfo(bgCtx, token, projID, qName)
+	assert.NoErr(t, err)
+	assert.Equal(t, info.Size, 2, "queue size")
+}
+
+func TestResolveHost(t *testing.T) {
+	assert.NoErr(t, NewHTTPClient(SchemeHTTP, "localhost", 8080).ResolveHost(bgCtx))
+	err := NewHTTPClient(SchemeHTTP, "gorion-test.invalid", 8080).ResolveHost(bgCtx)
+	assert.True(t, err != nil, "resolving an invalid host succeeded")
+}
+
+func TestHTTPDequeueDeleteTooMany(t *testing.T) {
+	srv := testsrv.StartServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(dequeueResp{Messages: []DequeuedMessage{{ID: 1}, {ID: 2}}})
+	}))
+	defer srv.Close()
+	var warnings []DequeueCountError
+	cl := newTestHTTPClient(t, srv, WithDequeueCountWarning(func(err *DequeueCountError) {
+		warnings = append(warnings, *err)
+	}))
+	msgs, err := cl.Dequeue(bgCtx, token, projID, qName, 1, Timeout(30), Wait(0), true)
+	assert.NoErr(t, err)
+	assert.Equal(t, len(msgs), 2, "number of dequeued messages")
+	assert.Equal(t, warnings, []DequeueCountError{{Requested: 1, Returned: 2}}, "count warnings")
+	msgs, err = cl.Dequeue(bgCtx, token, projID, qName, 2, Timeout(30), Wait(0), true)
+	assert.NoErr(t, err)
+	assert.Equal(t, len(msgs), 2, "number of dequeued messages")
+	assert.Equal(t, len(warnings), 1, "number of count warnings")
+}
+
+func TestHTTPSuccessStatuses(t *testing.T) {
+	srv := testsrv.StartServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotModified)
+	}))
+	defer srv.Close()
+	msgs := []NewMessage{{Body: "abc", PushHeaders: make(map[string]string)}}
+
+	_, err := newTestHTTPClient(t, srv).Enqueue(bgCtx, token, projID, qName, msgs)
+	httpErr, ok := err.(*HTTPError)
+	assert.True(t, ok, "returned error [%v] was not an *HTTPError", err)
+	assert.Equal(t, httpErr.StatusCode, http.StatusNotModified, "status code")
+
+	cl := newTestHTTPClient(t, srv, WithSuccessStatuses(http.StatusNotModified))
+	enq, err := cl.Enqueue(bgCtx, token, projID, qName, msgs)
+	assert.NoErr(t, err)
+	assert.Equal(t, len(enq.IDs), 0, "number of enqueued IDs")
+	assert.True(t, enq.QueueSize == nil, "queue size [%v] wasn't nil without a response body", enq.QueueSize)
+}
+
+func TestHTTPEnqueueMessageIDNotSent(t *testing.T) {
+	var body []byte
+	srv := testsrv.StartServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = ioutil.ReadAll(r.Body)
+		fmt.Fprint(w, `{"ids":["1"],"msg":"Messages put on queue."}`)
+	}))
+	defer srv.Close()
+	cl := newTestHTTPClient(t, srv)
+	enq, err := cl.Enqueue(bgCtx, token, projID, qName, []NewMessage{{Body: "abc", ID: "order-42", PushHeaders: make(map[string]string)}})
+	assert.NoErr(t, err)
+	assert.Equal(t, enq.IDs, []string{"1"}, "enqueued IDs")
+	assert.False(t, strings.Contains(string(body), "order-42"), "request body [%s] contained the client-assigned ID", string(body))
+	_, err = cl.Enqueue(bgCtx, token, projID, qName, []NewMessage{{Body: "abc", ID: "order 42", PushHeaders: make(map[string]string)}})
+	assert.Err(t, ErrInvalidMessageID, err)
+}
+
+type enqueueMetrics struct {
+	NopMetrics
+	enqueues int
+}
+
+func (e *enqueueMetrics) ObserveRequest(op string, dur time.Duration, err error) {
+	if op == OpEnqueue {
+		e.enqueues++
+	}
+}
+
+func TestHTTPEnqueueChunks(t *testing.T) {
+	srv := testsrv.StartServer(makeQHandler())
+	defer srv.Close()
+	metrics := new(enqueueMetrics)
+	const oneByteSize = 1 + EnqueueMsgOverheadBytes
+	cl := newTestHTTPClient(t, srv, WithMetricsRecorder(metrics), WithMaxBatchBytes(10*oneByteSize))
+	var msgs []NewMessage
+	for i := 0; i < MaxEnqueueBatch+1; i++ {
+		msgs = append(msgs, NewMessage{Body: "a", PushHeaders: make(map[string]string)})
+	}
+	msgs = append(msgs, NewMessage{Body: strings.Repeat("a", 10*oneByteSize), PushHeaders: make(map[string]string)})
+	enq, err := cl.Enqueue(bgCtx, token, projID, qName, msgs)
+	assert.NoErr(t, err)
+	assert.Equal(t, len(enq.IDs), len(msgs), "number of enqueued IDs")
+	// 101 one byte messages in chunks of ten, then the big message on its own
+	assert.Equal(t, metrics.enqueues, 12, "number of enqueue requests")
+	assert.True(t, enq.QueueSize != nil, "queue size wasn't reported")
+	assert.Equal(t, *enq.QueueSize, len(msgs), "reported queue size")
+	assert.Equal(t, queueSize(t, cl), len(msgs), "queue size")
+}
+
+func TestHTTPEnqueuePartialFailure(t *testing.T) {
+	var mtx sync.Mutex
+	numReqs := 0
+	srv := testsrv.StartServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		numReqs++
+		if numReqs > 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"msg":"enqueue failed"}`))
+			return
+		}
+		w.Write([]byte(`{"ids":["1","2"],"msg":"Messages put on queue"}`))
+	}))
+	defer srv.Close()
+	cl := newTestHTTPClient(t, srv, WithMaxBatchBytes(2*(1+EnqueueMsgOverheadBytes)), WithMessageURLs())
+	var msgs []NewMessage
+	for i := 0; i < 4; i++ {
+		msgs = append(msgs, NewMessage{Body: "a", PushHeaders: make(map[string]string)})
+	}
+	enq, err := cl.Enqueue(bgCtx, token, projID, qName, msgs)
+	assert.True(t, enq == nil, "returned a result along with the error")
+	partialErr, ok := err.(*PartialEnqueueError)
+	assert.True(t, ok, "returned error [%v] was not a *PartialEnqueueError", err)
+	assert.Equal(t, partialErr.Enqueued.IDs, []string{"1", "2"}, "IDs of the enqueued messages")
+	assert.Equal(t, len(partialErr.Enqueued.URLs), 2, "number of URLs of the enqueued messages")
+	httpErr, ok := partialErr.Err.(*HTTPError)
+	assert.True(t, ok, "failed request's error [%v] was not an *HTTPError", partialErr.Err)
+	assert.Equal(t, httpErr.StatusCode, http.StatusInternalServerError, "failed request's status code")
+	assert.Equal(t, numReqs, 2, "number of enqueue requests")
+
+	// a failure of the first request is returned as is
+	_, err = cl.Enqueue(bgCtx, token, projID, qName, msgs)
+	_, ok = err.(*HTTPError)
+	assert.True(t, ok, "returned error [%v] was not an *HTTPError", err)
+}
+
+func TestHTTPBodyCodec(t *testing.T) {
+	srv := testsrv.StartServer(makeQHandler())
+	defer srv.Close()
+	cl := newTestHTTPClient(t, srv, WithBodyCodec(GzipCodec{}))
+	const body = `{"num":1}`
+	_, err := cl.Enqueue(bgCtx, token, projID, qName, []NewMessage{{Body: body, PushHeaders: make(map[string]string)}})
+	assert.NoErr(t, err)
+	msgs, err := cl.Dequeue(bgCtx, token, projID, qName, 1, Timeout(30), Wait(1), false)
+	assert.NoErr(t, err)
+	assert.Equal(t, len(msgs), 1, "number of dequeued messages")
+	assert.True(t, msgs[0].Body != body, "body wasn't encoded")
+	decoded, err := DecodeBody(msgs[0])
+	assert.NoErr(t, err)
+	assert.Equal(t, decoded, body, "decoded body")
+}
+
+func TestHTTPUnexpectedContentType(t *testing.T) {
+	const page = "<html><body>Bad Gateway</body></html>"
+	for _, contentType := range []string{"text/html; charset=utf-8", "text/plain"} {
+		srv := testsrv.StartServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", contentType)
+			w.Write([]byte("\n" + page))
+		}))
+		_, err := newTestHTTPClient(t, srv).GetQueueInfo(bgCtx, token, projID, qName)
+		srv.Close()
+		ctErr, ok := err.(*UnexpectedContentTypeError)
+		assert.True(t, ok, "returned error [%v] was not an *UnexpectedContentTypeError", err)
+		assert.True(t, errors.Is(err, ErrUnexpectedContentType), "error didn't match ErrUnexpectedContentType")
+		assert.Equal(t, ctErr.StatusCode, http.StatusOK, "status code")
+		assert.Equal(t, ctErr.ContentType, contentType, "content type")
+		assert.Equal(t, ctErr.Snippet, page, "body snippet")
+	}
+}
+
+func TestHTTPStreamingEncode(t *testing.T) {
+	qHandler := makeQHandler()
+	lengths := make(chan int64, 1)
+	srv := testsrv.StartServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			lengths <- r.ContentLength
+		}
+		qHandler.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	cl := newTestHTTPClient(t, srv, WithStreamingEncode())
+	enq, err := cl.Enqueue(bgCtx, token, projID, qName, []NewMessage{{Body: "abc", PushHeaders: make(map[string]string)}})
+	assert.NoErr(t, err)
+	assert.Equal(t, len(enq.IDs), 1, "number of enqueued IDs")
+	// a streamed body has no length upfront
+	assert.Equal(t, <-lengths, int64(-1), "content length")
+	assert.Equal(t, queueSize(t, cl), 1, "queue size")
+}
+
+func TestHTTPAutoCreateQueue(t *testing.T) {
+	srv := testsrv.StartServer(makeQHandler())
+	defer srv.Close()
+	cl := newTestHTTPClient(t, srv, WithAutoCreateQueue(QueueConfig{Type: "pull", MessageTimeout: 60}))
+	info, err := cl.GetQueueInfo(bgCtx, token, projID, qName)
+	assert.NoErr(t, err)
+	assert.Equal(t, info.Name, qName, "queue name")
+	assert.Equal(t, info.Size, 0, "queue size")
+
+	puts := 0
+	failing := testsrv.StartServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PUT" {
+			puts++
+			http.Error(w, `{"msg":"creating queues is broken"}`, http.StatusInternalServerError)
+			return
+		}
+		http.Error(w, `{"msg":"Queue not found"}`, http.StatusNotFound)
+	}))
+	defer failing.Close()
+	_, err = newTestHTTPClient(t, failing, WithAutoCreateQueue(QueueConfig{})).Dequeue(bgCtx, token, projID, qName, 1, Timeout(30), Wait(0), false)
+	httpErr, ok := err.(*HTTPError)
+	assert.True(t, ok, "returned error [%v] was not an *HTTPError", err)
+	assert.Equal(t, httpErr.StatusCode, http.StatusInternalServerError, "status code")
+	assert.Equal(t, puts, 1, "number of queue creation attempts")
+}
+
+func TestHTTPConcurrentDecode(t *testing.T) {
+	srv := testsrv.StartServer(makeQHandler())
+	defer srv.Close()
+	cl := newTestHTTPClient(t, srv)
+	var msgs []NewMessage
+	for i := 0; i < 20; i++ {
+		msgs = append(msgs, NewMessage{Body: strings.Repeat(strconv.Itoa(i%10), 100+i), PushHeaders: make(map[string]string)})
+	}
+	_, err := cl.Enqueue(bgCtx, token, projID, qName, msgs)
+	assert.NoErr(t, err)
+	// the response buffers are pooled, so concurrent requests must each decode their own response
+	var wg sync.WaitGroup
+	errCh := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				peeked, err := cl.Peek(bgCtx, token, projID, qName, MaxPeek)
+				if err != nil {
+					errCh <- err
+					return
+				}
+				for k, msg := range peeked {
+					if msg.Body != msgs[k].Body {
+						errCh <- fmt.Errorf("body of message [%d] was [%s]", k, msg.Body)
+						return
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errCh)
+	for err := range errCh {
+		t.Error(err)
+	}
+}
+
+func BenchmarkHTTPDequeue(b *testing.B) {
+	var msgs []DequeuedMessage
+	for i := 0; i < 10; i++ {
+		msgs = append(msgs, DequeuedMessage{ID: i, Body: strings.Repeat("a", 1024), ReservedCount: 1, ReservationID: strconv.Itoa(i)})
+	}
+	resp, err := json.Marshal(dequeueResp{Messages: msgs})
+	if err != nil {
+		b.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(resp)
+	}))
+	defer srv.Close()
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		b.Fatal(err)
+	}
+	port, err := strconv.Atoi(u.Port())
+	if err != nil {
+		b.Fatal(err)
+	}
+	cl := NewHTTPClient(SchemeHTTP, u.Hostname(), uint16(port))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := cl.Dequeue(bgCtx, token, projID, qName, 10, Timeout(30), Wait(0), false); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package mq
 
 import (
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -10,9 +11,13 @@ import (
 	"golang.org/x/net/context"
 )
 
+// memMsg is never JSON-encoded. The embedded NewMessage is tagged so that its JSON fields don't
+// clash with the DequeuedMessage ones
 type memMsg struct {
-	NewMessage
+	NewMessage `json:"-"`
 	DequeuedMessage
+	// the qKey of the queue the message was enqueued onto
+	key string
 }
 
 // MemClient is a Client implementation for pure in-memory queues. It's intended
@@ -26,19 +31,37 @@ type MemClient struct {
 	queues map[string][]memMsg
 	// the map from reservation ID to the message
 	reserved map[string]memMsg
+	// the number of messages ever enqueued, by qKey
+	totals map[string]int
+	// the types of the queues that were created with a type, by qKey
+	types map[string]string
+	// the simulated network conditions, if non-nil
+	sim *memSim
 }
 
 // NewMemClient returns a purely in-memory Client implementation that can be used
 // for testing. Note that funcs with in-memory client receivers do not pay attention
-// to the context.Context parameters that are passed to them.
-func NewMemClient() *MemClient {
+// to the context.Context parameters that are passed to them, except while waiting for the
+// latency from WithSimulatedLatency. Any opts are applied in order, to simulate network
+// conditions such as latency and failing requests
+func NewMemClient(opts ...MemClientOption) *MemClient {
 	mtx := sync.Mutex{}
+	var sim *memSim
+	if len(opts) > 0 {
+		sim = &memSim{}
+		for _, opt := range opts {
+			opt(sim)
+		}
+	}
 	return &MemClient{
+		sim:      sim,
 		lck:      &mtx,
 		tmr:      timer.NewTimer(),
 		ctr:      0,
 		queues:   make(map[string][]memMsg),
 		reserved: make(map[string]memMsg),
+		totals:   make(map[string]int),
+		types:    make(map[string]string),
 	}
 }
 
@@ -51,6 +74,7 @@ func (m *MemClient) newMemMsg(n NewMessage) memMsg {
 			Body:          n.Body,
 			ReservedCount: 0,
 			ReservationID: "",
+			PushHeaders:   n.PushHeaders,
 		},
 	}
 }
@@ -61,11 +85,19 @@ func qKey(projID, qName string) string {
 
 // Enqueue is the interface implementation
 func (m *MemClient) Enqueue(ctx context.Context, token, projID, qName string, msgs []NewMessage) (*Enqueued, error) {
+	if err := checkMessageIDs(msgs); err != nil {
+		return nil, err
+	}
+	if err := m.simulate(ctx, OpEnqueue); err != nil {
+		return nil, err
+	}
 	ret := &Enqueued{}
 	m.lck.Lock()
 	defer m.lck.Unlock()
 	for _, msg := range msgs {
 		mmsg := m.newMemMsg(msg)
+		mmsg.key = qKey(projID, qName)
+		m.totals[mmsg.key]++
 		if mmsg.Delay > 0 {
 			go m.deferEnqueue(projID, qName, mmsg)
 		} else {
@@ -73,66 +105,232 @@ func (m *MemClient) Enqueue(ctx context.Context, token, projID, qName string, ms
 			q = append(q, mmsg)
 			m.queues[qKey(projID, qName)] = q
 		}
-		ret.IDs = append(ret.IDs, string(mmsg.ID))
+		ret.IDs = append(ret.IDs, strconv.Itoa(mmsg.DequeuedMessage.ID))
 	}
 	ret.Msg = "Messages put on queue"
+	size := m.size(qKey(projID, qName))
+	ret.QueueSize = &size
 	return ret, nil
 }
 
-// Dequeue is the interface implementation
+// Dequeue is the interface implementation. Like IronMQ, it returns as soon as it has reserved
+// at least one message, or after wait expires if no messages were available
 func (m *MemClient) Dequeue(ctx context.Context, token, projID, qName string, num int, timeout Timeout, wait Wait, delete bool) ([]DequeuedMessage, error) {
-	ch := make(chan memMsg)
-
-	go func() {
-		m.lck.Lock()
-		defer m.lck.Unlock()
-		timeCh := m.tmr.After(time.Duration(int(wait)) * time.Second)
-		q := m.queues[qKey(projID, qName)]
-		for {
-			select {
-			case <-timeCh:
-				close(ch)
-				return
-			default:
-				if len(q) <= 0 {
-					m.tmr.Sleep(100 * time.Millisecond)
-				} else {
-					msg := q[0]
-					q = q[1:]
-					m.queues[qKey(projID, qName)] = q
-					msg.ReservedCount++
-					msg.ReservationID = uuid.New()
-					if !delete {
-						m.reserved[msg.ReservationID] = msg
-						go m.releaseReservedMsg(projID, qName, msg.ReservationID, timeout)
-					}
-					ch <- msg
-				}
-			}
+	if !timeoutInRange(timeout) {
+		return nil, ErrTimeoutOutOfRange
+	}
+	if !waitInRange(wait) {
+		return nil, ErrWaitOutOfRange
+	}
+	if err := m.simulate(ctx, OpDequeue); err != nil {
+		return nil, err
+	}
+	timeCh := m.tmr.After(time.Duration(int(wait)) * time.Second)
+	for {
+		if ret := m.reserve(projID, qName, num, timeout, delete); len(ret) > 0 || wait == 0 {
+			return ret, nil
+		}
+		select {
+		case <-timeCh:
+			return nil, nil
+		default:
+			m.tmr.Sleep(100 * time.Millisecond)
 		}
-	}()
+	}
+}
 
+// reserve takes at most num messages off the front of the queue and reserves them for timeout,
+// or forgets about them entirely if delete is true
+func (m *MemClient) reserve(projID, qName string, num int, timeout Timeout, delete bool) []DequeuedMessage {
+	m.lck.Lock()
+	defer m.lck.Unlock()
 	var ret []DequeuedMessage
-	for r := range ch {
-		ret = append(ret, r.DequeuedMessage)
+	q := m.queues[qKey(projID, qName)]
+	for len(q) > 0 && len(ret) < num {
+		msg := q[0]
+		q = q[1:]
+		msg.ReservedCount++
+		msg.ReservationID = uuid.New()
+		if !delete {
+			m.reserved[msg.ReservationID] = msg
+			go m.releaseReservedMsg(projID, qName, msg.ReservationID, timeout)
+		}
+		ret = append(ret, msg.DequeuedMessage)
 	}
-	return ret, nil
+	m.queues[qKey(projID, qName)] = q
+	return ret
 }
 
 // DeleteReserved is the interface implementation
 func (m *MemClient) DeleteReserved(ctx context.Context, token, projID, qName string, messageID int, reservationID string) (*Deleted, error) {
+	if err := m.simulate(ctx, OpDeleteReserved); err != nil {
+		return nil, err
+	}
 	m.lck.Lock()
 	defer m.lck.Unlock()
 	msg, ok := m.reserved[reservationID]
 	if !ok {
+		if m.hasMessage(qKey(projID, qName), messageID) {
+			return nil, ErrAlreadyRedelivered
+		}
 		return nil, ErrNoSuchReservation
 	}
-	if msg.ID != messageID {
+	if msg.DequeuedMessage.ID != messageID {
 		return nil, ErrNoSuchMessage
 	}
+	delete(m.reserved, reservationID)
 	return &Deleted{Msg: "deleted"}, nil
 }
 
+// MessageExists is the interface implementation. Messages that were enqueued or released with a
+// delay aren't found until the delay elapses
+func (m *MemClient) MessageExists(ctx context.Context, token, projID, qName string, messageID int) (bool, error) {
+	if err := m.simulate(ctx, OpGetMessage); err != nil {
+		return false, err
+	}
+	m.lck.Lock()
+	defer m.lck.Unlock()
+	return m.hasMessage(qKey(projID, qName), messageID), nil
+}
+
+// hasMessage returns true if the message with the given ID is available on the queue with the
+// given key or reserved from it. Messages that were released with a delay aren't found until
+// the delay elapses. Must be called with m.lck held
+func (m *MemClient) hasMessage(key string, messageID int) bool {
+	for _, msg := range m.queues[key] {
+		if msg.DequeuedMessage.ID == messageID {
+			return true
+		}
+	}
+	for _, msg := range m.reserved {
+		if msg.key == key && msg.DequeuedMessage.ID == messageID {
+			return true
+		}
+	}
+	return false
+}
+
+// ReleaseReserved is the interface implementation
+func (m *MemClient) ReleaseReserved(ctx context.Context, token, projID, qName string, messageID int, reservationID string, delay Delay) (*Released, error) {
+	if !delayInRange(delay) {
+		return nil, ErrDelayOutOfRange
+	}
+	if err := m.simulate(ctx, OpReleaseReserved); err != nil {
+		return nil, err
+	}
+	m.lck.Lock()
+	defer m.lck.Unlock()
+	msg, ok := m.reserved[reservationID]
+	if !ok {
+		return nil, ErrNoSuchReservation
+	}
+	if msg.DequeuedMessage.ID != messageID {
+		return nil, ErrNoSuchMessage
+	}
+	delete(m.reserved, reservationID)
+	if delay > 0 {
+		msg.Delay = uint32(delay)
+		go m.deferEnqueue(projID, qName, msg)
+	} else {
+		m.queues[qKey(projID, qName)] = append(m.queues[qKey(projID, qName)], msg)
+	}
+	return &Released{Msg: "released"}, nil
+}
+
+// TouchReserved is the interface implementation
+func (m *MemClient) TouchReserved(ctx context.Context, token, projID, qName string, messageID int, reservationID string, timeout Timeout) (*Touched, error) {
+	if !timeoutInRange(timeout) {
+		return nil, ErrTimeoutOutOfRange
+	}
+	if err := m.simulate(ctx, OpTouchReserved); err != nil {
+		return nil, err
+	}
+	m.lck.Lock()
+	defer m.lck.Unlock()
+	msg, ok := m.reserved[reservationID]
+	if !ok {
+		return nil, ErrNoSuchReservation
+	}
+	if msg.DequeuedMessage.ID != messageID {
+		return nil, ErrNoSuchMessage
+	}
+	delete(m.reserved, reservationID)
+	msg.ReservationID = uuid.New()
+	m.reserved[msg.ReservationID] = msg
+	go m.releaseReservedMsg(projID, qName, msg.ReservationID, timeout)
+	return &Touched{ReservationID: msg.ReservationID, Msg: "touched"}, nil
+}
+
+// Peek is the interface implementation
+func (m *MemClient) Peek(ctx context.Context, token, projID, qName string, num int) ([]Message, error) {
+	if num > MaxPeek {
+		num = MaxPeek
+	}
+	if err := m.simulate(ctx, OpPeek); err != nil {
+		return nil, err
+	}
+	m.lck.Lock()
+	defer m.lck.Unlock()
+	var ret []Message
+	for _, msg := range m.queues[qKey(projID, qName)] {
+		if len(ret) >= num {
+			break
+		}
+		ret = append(ret, Message{ID: msg.DequeuedMessage.ID, Body: msg.DequeuedMessage.Body, ReservedCount: msg.ReservedCount})
+	}
+	return ret, nil
+}
+
+// PutQueue is the interface implementation. MemClient queues have no config other than their
+// type, so the rest of cfg is ignored
+func (m *MemClient) PutQueue(ctx context.Context, token, projID, qName string, cfg QueueConfig) (*QueueInfo, error) {
+	if err := m.simulate(ctx, OpPutQueue); err != nil {
+		return nil, err
+	}
+	m.lck.Lock()
+	key := qKey(projID, qName)
+	if _, ok := m.totals[key]; !ok {
+		m.totals[key] = 0
+	}
+	if cfg.Type != "" {
+		m.types[key] = cfg.Type
+	}
+	m.lck.Unlock()
+	return m.queueInfo(projID, qName)
+}
+
+// GetQueueInfo is the interface implementation. The returned size doesn't include messages
+// that are delayed, and a queue doesn't exist until something is enqueued onto it
+func (m *MemClient) GetQueueInfo(ctx context.Context, token, projID, qName string) (*QueueInfo, error) {
+	if err := m.simulate(ctx, OpGetQueueInfo); err != nil {
+		return nil, err
+	}
+	return m.queueInfo(projID, qName)
+}
+
+func (m *MemClient) queueInfo(projID, qName string) (*QueueInfo, error) {
+	m.lck.Lock()
+	defer m.lck.Unlock()
+	key := qKey(projID, qName)
+	total, ok := m.totals[key]
+	if !ok {
+		return nil, ErrNoSuchQueue
+	}
+	return &QueueInfo{Name: qName, ProjectID: projID, Size: m.size(key), TotalMessages: total, Type: m.types[key]}, nil
+}
+
+// size returns the number of available and reserved messages in the queue at key. m.lck must be
+// held
+func (m *MemClient) size(key string) int {
+	size := len(m.queues[key])
+	for _, msg := range m.reserved {
+		if msg.key == key {
+			size++
+		}
+	}
+	return size
+}
+
 func (m *MemClient) releaseReservedMsg(projID, qName, resID string, timeout Timeout) {
 	m.tmr.Sleep(time.Duration(int(timeout)) * time.Second)
 	m.lck.Lock()
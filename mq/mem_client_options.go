@@ -0,0 +1,82 @@
+package mq
+
+import (
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// MemClientOption configures how a MemClient simulates network conditions. Pass any number of
+// them to NewMemClient
+type MemClientOption func(*memSim)
+
+// WithSimulatedLatency makes every MemClient operation wait for d before it does anything. If
+// ctx.Done() receives while it's waiting, the operation returns ctx.Err() without being applied
+func WithSimulatedLatency(d time.Duration) MemClientOption {
+	return func(s *memSim) {
+		s.latency = d
+	}
+}
+
+// WithErrorRate makes each MemClient operation fail with probability rate, from 0 to 1, with an
+// *HTTPError with status code 503, as if the server was temporarily unavailable. Failed
+// operations aren't applied. The failures are drawn from a random source seeded with seed, so
+// the same sequence of operations fails the same way every time
+func WithErrorRate(rate float64, seed int64) MemClientOption {
+	return func(s *memSim) {
+		s.errRate = rate
+		s.rnd = rand.New(rand.NewSource(seed))
+	}
+}
+
+// WithForcedStatus makes the next n MemClient operations fail with an *HTTPError with the given
+// status code, such as 429 or 503, and the ones after them succeed as usual. n < 0 makes every
+// operation fail. Failed operations aren't applied
+func WithForcedStatus(code, n int) MemClientOption {
+	return func(s *memSim) {
+		s.forcedStatus = code
+		s.forcedLeft = n
+	}
+}
+
+// memSim simulates network conditions for a MemClient
+type memSim struct {
+	latency time.Duration
+
+	mtx          sync.Mutex
+	errRate      float64
+	rnd          *rand.Rand
+	forcedStatus int
+	forcedLeft   int
+}
+
+// simulate waits for the simulated latency and then returns the simulated error for op, if any.
+// It doesn't simulate anything if m has no options
+func (m *MemClient) simulate(ctx context.Context, op string) error {
+	s := m.sim
+	if s == nil {
+		return nil
+	}
+	if s.latency > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-m.tmr.After(s.latency):
+		}
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.forcedLeft != 0 {
+		if s.forcedLeft > 0 {
+			s.forcedLeft--
+		}
+		return &HTTPError{StatusCode: s.forcedStatus, Msg: "simulated " + op + " failure"}
+	}
+	if s.rnd != nil && s.rnd.Float64() < s.errRate {
+		return &HTTPError{StatusCode: http.StatusServiceUnavailable, Msg: "simulated " + op + " failure"}
+	}
+	return nil
+}
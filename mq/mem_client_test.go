@@ -1,12 +1,14 @@
 package mq
 
 import (
+	"net/http"
 	"testing"
 	"time"
 
 	"github.com/arschles/assert"
 	"github.com/arschles/synctest"
 	"github.com/pivotal-golang/timer/fake_timer"
+	"golang.org/x/net/context"
 )
 
 func TestReleaseReservedMsg(t *testing.T) {
@@ -49,3 +51,66 @@ func TestMemQueueOperations(t *testing.T) {
 	err := qOperations(cl)
 	assert.NoErr(t, err)
 }
+
+func TestMemDeleteAfterRedelivery(t *testing.T) {
+	assert.NoErr(t, deleteAfterRedelivery(NewMemClient()))
+	cl := NewMemClient()
+	_, err := cl.DeleteReserved(bgCtx, token, projID, qName, 1, "nonexistent")
+	assert.Err(t, ErrNoSuchReservation, err)
+}
+
+func TestMemMessageExists(t *testing.T) {
+	assert.NoErr(t, messageExists(NewMemClient()))
+}
+
+func TestMemForcedStatus(t *testing.T) {
+	cl := NewMemClient(WithForcedStatus(http.StatusTooManyRequests, 2))
+	for i := 0; i < 2; i++ {
+		_, err := cl.Enqueue(bgCtx, token, projID, qName, []NewMessage{{Body: "abc", PushHeaders: make(map[string]string)}})
+		httpErr, ok := err.(*HTTPError)
+		assert.True(t, ok, "returned error [%v] was not an *HTTPError", err)
+		assert.Equal(t, httpErr.StatusCode, http.StatusTooManyRequests, "status code")
+		assert.True(t, retryable(err), "forced 429 wasn't retryable")
+	}
+	_, err := cl.Enqueue(bgCtx, token, projID, qName, []NewMessage{{Body: "abc", PushHeaders: make(map[string]string)}})
+	assert.NoErr(t, err)
+	// the failed enqueues weren't applied
+	assert.Equal(t, queueSize(t, cl), 1, "queue size")
+}
+
+func TestMemErrorRate(t *testing.T) {
+	failures := func(cl *MemClient) []bool {
+		var ret []bool
+		for i := 0; i < 20; i++ {
+			_, err := cl.Peek(bgCtx, token, projID, qName, 1)
+			ret = append(ret, err != nil)
+		}
+		return ret
+	}
+	first := failures(NewMemClient(WithErrorRate(0.5, 42)))
+	assert.Equal(t, failures(NewMemClient(WithErrorRate(0.5, 42))), first, "failures with the same seed")
+	numFailed := 0
+	for _, failed := range first {
+		if failed {
+			numFailed++
+		}
+	}
+	assert.True(t, numFailed > 0 && numFailed < len(first), "[%d] of [%d] peeks failed", numFailed, len(first))
+	for _, failed := range failures(NewMemClient(WithErrorRate(0, 42))) {
+		assert.False(t, failed, "peek failed with an error rate of 0")
+	}
+}
+
+func TestMemSimulatedLatency(t *testing.T) {
+	cl := NewMemClient(WithSimulatedLatency(50 * time.Millisecond))
+	start := time.Now()
+	_, err := cl.Peek(bgCtx, token, projID, qName, 1)
+	assert.NoErr(t, err)
+	assert.True(t, time.Since(start) >= 50*time.Millisecond, "peek returned after [%s]", time.Since(start))
+	ctx, cancel := context.WithTimeout(bgCtx, 10*time.Millisecond)
+	defer cancel()
+	_, err = cl.Enqueue(ctx, token, projID, qName, []NewMessage{{Body: "abc", PushHeaders: make(map[string]string)}})
+	assert.Err(t, context.DeadlineExceeded, err)
+	_, err = cl.GetQueueInfo(bgCtx, token, projID, qName)
+	assert.Err(t, ErrNoSuchQueue, err)
+}
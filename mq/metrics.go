@@ -0,0 +1,73 @@
+package mq
+
+import "time"
+
+// The names of the operations that an HTTPClient reports to MetricsRecorder.ObserveRequest
+const (
+	OpEnqueue         = "enqueue"
+	OpDequeue         = "dequeue"
+	OpDeleteReserved  = "delete_reserved"
+	OpReleaseReserved = "release_reserved"
+	OpTouchReserved   = "touch_reserved"
+	OpPeek            = "peek"
+	OpGetMessage      = "get_message"
+	OpGetQueueInfo    = "get_queue_info"
+	OpPutQueue        = "put_queue"
+)
+
+// MetricsRecorder receives measurements about the operations an HTTPClient performs, and about
+// the messages a consumer processes. Implementations must be safe for concurrent use. Use
+// WithMetricsRecorder to install one in an HTTPClient, and ConsumeOptions.Metrics to install one
+// in a consumer
+type MetricsRecorder interface {
+	// ObserveRequest is called after each request to the IronMQ API with the name of the
+	// operation (one of the Op constants), how long the request took and the error it failed
+	// with, if any. Retried requests are reported once per attempt
+	ObserveRequest(op string, dur time.Duration, err error)
+
+	// ObserveReserved is called after each successful Dequeue with the number of messages
+	// that were reserved from qName and the total size of their bodies in bytes
+	ObserveReserved(qName string, num, bytes int)
+
+	// ObserveRedelivered is called after each successful Dequeue with the number of reserved
+	// messages that were redeliveries (see DequeuedMessage.IsRedelivery)
+	ObserveRedelivered(qName string, num int)
+
+	// ObserveProcessed is called by consumers each time they successfully delete a message from
+	// qName, with the time between when the message was reserved and when it was deleted. This
+	// is mostly the time it took to handle the message
+	ObserveProcessed(qName string, dur time.Duration)
+
+	// ObserveConn is called each time a request for op got a connection, with whether it reused
+	// an idle connection or had to open a new one. It's only called by HTTPClients created with
+	// WithConnTrace. A low ratio of reused connections usually means the idle connection pool is
+	// too small for the request rate, or that too many short-lived clients are being created
+	ObserveConn(op string, reused bool)
+
+	// ObserveDwell is called after each successful Dequeue for every reserved message from qName
+	// that has a HeaderEnqueuedAt push header, with how long the message was in the queue. It's
+	// only called by HTTPClients created with WithDwellTime
+	ObserveDwell(qName string, dur time.Duration)
+}
+
+// NopMetrics is a MetricsRecorder that discards all measurements. Embed it in your own
+// MetricsRecorder to implement only the funcs you're interested in
+type NopMetrics struct{}
+
+// ObserveRequest is the interface implementation
+func (NopMetrics) ObserveRequest(op string, dur time.Duration, err error) {}
+
+// ObserveReserved is the interface implementation
+func (NopMetrics) ObserveReserved(qName string, num, bytes int) {}
+
+// ObserveRedelivered is the interface implementation
+func (NopMetrics) ObserveRedelivered(qName string, num int) {}
+
+// ObserveProcessed is the interface implementation
+func (NopMetrics) ObserveProcessed(qName string, dur time.Duration) {}
+
+// ObserveConn is the interface implementation
+func (NopMetrics) ObserveConn(op string, reused bool) {}
+
+// ObserveDwell is the interface implementation
+func (NopMetrics) ObserveDwell(qName string, dur time.Duration) {}
@@ -8,6 +8,39 @@ type NewMessage struct {
 	Delay uint32 `json:"delay"`
 	// The push headers of the message. When creating a new message, ensure that this is non-nil
 	PushHeaders map[string]string `json:"push_headers"`
+	// ID is an optional ID assigned by the producer, for example to correlate the message with
+	// its own records. IronMQ v3 always assigns message IDs itself and has no way to accept one
+	// from the client, so ID is never sent and the message still gets the ID returned in
+	// Enqueued.IDs. Enqueue only checks that it's valid: at most MaxMessageIDLen letters, digits,
+	// '-' or '_'. To pass an ID along with the message so consumers can see it, put it in the
+	// push headers or the body as well
+	ID string `json:"-"`
+}
+
+// MaxMessageIDLen is the maximum length of NewMessage.ID
+const MaxMessageIDLen = 64
+
+// checkMessageIDs returns ErrInvalidMessageID if any of msgs has an invalid ID
+func checkMessageIDs(msgs []NewMessage) error {
+	for _, msg := range msgs {
+		if len(msg.ID) > MaxMessageIDLen {
+			return ErrInvalidMessageID
+		}
+		for _, r := range msg.ID {
+			valid := (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '-' || r == '_'
+			if !valid {
+				return ErrInvalidMessageID
+			}
+		}
+	}
+	return nil
+}
+
+// Message represents a message that's available on an IronMQ queue, as returned by Peek
+type Message struct {
+	ID            int    `json:"id"`
+	Body          string `json:"body"`
+	ReservedCount int    `json:"reserved_count"`
 }
 
 // DequeuedMessage represents a message that has been dequeued from IronMQ.
@@ -16,4 +49,81 @@ type DequeuedMessage struct {
 	Body          string `json:"body"`
 	ReservedCount int    `json:"reserved_count"`
 	ReservationID string `json:"reservation_id"`
+	// The push headers the message was enqueued with. This is only populated if the server
+	// returns push headers along with reserved messages
+	PushHeaders map[string]string `json:"push_headers,omitempty"`
+}
+
+// IsRedelivery returns true if the message was reserved before, which means that an earlier
+// reservation timed out or was released, usually because whoever held it failed to handle it
+func (d DequeuedMessage) IsRedelivery() bool {
+	return d.ReservedCount > 1
+}
+
+// Size returns the size of the message body in bytes
+func (d DequeuedMessage) Size() int {
+	return len(d.Body)
+}
+
+// enqueueSize returns how many bytes msg adds to an enqueue request, counting its body, its push
+// headers and EnqueueMsgOverheadBytes, the same way SuggestBatchSize does
+func enqueueSize(msg NewMessage) int {
+	size := len(msg.Body) + EnqueueMsgOverheadBytes
+	for k, v := range msg.PushHeaders {
+		size += len(k) + len(v)
+	}
+	return size
+}
+
+// chunkMessages splits msgs into consecutive chunks of at most maxNum messages whose enqueue sizes
+// (see enqueueSize) add up to at most maxBytes. A message that's bigger than maxBytes alone gets
+// a chunk of its own. None of the chunks are empty
+func chunkMessages(msgs []NewMessage, maxNum, maxBytes int) [][]NewMessage {
+	var chunks [][]NewMessage
+	start, numBytes := 0, 0
+	for i, msg := range msgs {
+		size := enqueueSize(msg)
+		if i > start && (i-start >= maxNum || numBytes+size > maxBytes) {
+			chunks = append(chunks, msgs[start:i])
+			start, numBytes = i, 0
+		}
+		numBytes += size
+	}
+	if start < len(msgs) {
+		chunks = append(chunks, msgs[start:])
+	}
+	return chunks
+}
+
+// DeleteItem identifies a single reserved message in a batch delete or touch payload
+type DeleteItem struct {
+	ID            int    `json:"id"`
+	ReservationID string `json:"reservation_id"`
+}
+
+// ReservationIDs returns the reservation IDs of msgs, in order
+func ReservationIDs(msgs []DequeuedMessage) []string {
+	ret := make([]string, len(msgs))
+	for i, msg := range msgs {
+		ret[i] = msg.ReservationID
+	}
+	return ret
+}
+
+// MessageIDs returns the message IDs of msgs, in order
+func MessageIDs(msgs []DequeuedMessage) []int {
+	ret := make([]int, len(msgs))
+	for i, msg := range msgs {
+		ret[i] = msg.ID
+	}
+	return ret
+}
+
+// DeleteItems returns a DeleteItem for each of msgs, in order
+func DeleteItems(msgs []DequeuedMessage) []DeleteItem {
+	ret := make([]DeleteItem, len(msgs))
+	for i, msg := range msgs {
+		ret[i] = DeleteItem{ID: msg.ID, ReservationID: msg.ReservationID}
+	}
+	return ret
 }
@@ -0,0 +1,48 @@
+package mq
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/arschles/assert"
+)
+
+func TestBatchHelpers(t *testing.T) {
+	msgs := []DequeuedMessage{
+		{ID: 1, Body: "abc", ReservedCount: 1, ReservationID: "r1"},
+		{ID: 2, Body: "def", ReservedCount: 1, ReservationID: "r2"},
+	}
+	assert.Equal(t, ReservationIDs(msgs), []string{"r1", "r2"}, "reservation IDs")
+	assert.Equal(t, MessageIDs(msgs), []int{1, 2}, "message IDs")
+	assert.Equal(t, DeleteItems(msgs), []DeleteItem{{ID: 1, ReservationID: "r1"}, {ID: 2, ReservationID: "r2"}}, "delete items")
+	assert.Equal(t, len(DeleteItems(nil)), 0, "number of delete items for no messages")
+}
+
+func TestChunkMessages(t *testing.T) {
+	msgs := []NewMessage{{Body: "ab"}, {Body: "cd"}, {Body: "efghij"}, {Body: "k"}, {Body: "l"}, {Body: "m"}}
+	chunkSizes := func(chunks [][]NewMessage) []int {
+		ret := make([]int, len(chunks))
+		for i, chunk := range chunks {
+			ret[i] = len(chunk)
+		}
+		return ret
+	}
+	const o = EnqueueMsgOverheadBytes
+	assert.Equal(t, chunkSizes(chunkMessages(msgs, 100, 3*o+5)), []int{2, 2, 2}, "chunk sizes by bytes")
+	// every message is over the byte budget by itself, so each gets its own chunk
+	assert.Equal(t, chunkSizes(chunkMessages(msgs, 100, o)), []int{1, 1, 1, 1, 1, 1}, "chunk sizes for oversized messages")
+	assert.Equal(t, chunkSizes(chunkMessages(msgs, 4, 100*o)), []int{4, 2}, "chunk sizes by count")
+	assert.Equal(t, chunkSizes(chunkMessages(msgs, 2, 2*o+6)), []int{2, 1, 2, 1}, "chunk sizes by count and bytes")
+	assert.Equal(t, len(chunkMessages(nil, 100, 100)), 0, "number of chunks for no messages")
+
+	// push headers count too
+	withHeaders := []NewMessage{{Body: "ab", PushHeaders: map[string]string{"key": "value"}}, {Body: "cd"}}
+	assert.Equal(t, chunkSizes(chunkMessages(withHeaders, 100, 2*o+4)), []int{1, 1}, "chunk sizes with push headers")
+	assert.Equal(t, chunkSizes(chunkMessages(withHeaders, 100, 2*o+12)), []int{2}, "chunk sizes with push headers")
+}
+
+func TestCheckMessageIDs(t *testing.T) {
+	assert.NoErr(t, checkMessageIDs([]NewMessage{{Body: "a"}, {Body: "b", ID: "order-42_a"}}))
+	assert.Err(t, ErrInvalidMessageID, checkMessageIDs([]NewMessage{{Body: "a", ID: "order 42"}}))
+	assert.Err(t, ErrInvalidMessageID, checkMessageIDs([]NewMessage{{Body: "a", ID: strings.Repeat("a", MaxMessageIDLen+1)}}))
+}
@@ -0,0 +1,107 @@
+package mq
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// NoopClient is a Client implementation that performs no queue I/O at all. It's intended for
+// turning queueing off, for example in environments that don't have access to IronMQ, without
+// changing the code that uses the Client. Its behavior is:
+//
+//   - Enqueue discards the messages and returns a new, increasing ID for each one
+//   - Dequeue returns no messages after waiting for wait seconds, as if the queue was empty, so
+//     that consumers of a NoopClient don't spin. It returns ctx.Err() early if ctx.Done()
+//     receives while it's waiting
+//   - DeleteReserved, ReleaseReserved and TouchReserved succeed for any message and reservation.
+//     TouchReserved returns the reservation ID it was given
+//   - Peek returns no messages, and MessageExists returns false
+//   - PutQueue and GetQueueInfo return an empty queue with the given name and project ID
+//
+// Every operation still returns the same errors as other clients for out of range arguments,
+// but only Dequeue looks at ctx. The zero value is ready to use
+type NoopClient struct {
+	// the counter for fabricated message IDs
+	ctr uint64
+}
+
+// NewNoopClient returns a new NoopClient
+func NewNoopClient() *NoopClient {
+	return &NoopClient{}
+}
+
+// Enqueue is the interface implementation
+func (n *NoopClient) Enqueue(ctx context.Context, token, projID, qName string, msgs []NewMessage) (*Enqueued, error) {
+	if err := checkMessageIDs(msgs); err != nil {
+		return nil, err
+	}
+	ret := &Enqueued{Msg: "Messages put on queue"}
+	for range msgs {
+		ret.IDs = append(ret.IDs, strconv.FormatUint(atomic.AddUint64(&n.ctr, 1), 10))
+	}
+	return ret, nil
+}
+
+// Dequeue is the interface implementation
+func (n *NoopClient) Dequeue(ctx context.Context, token, projID, qName string, num int, timeout Timeout, wait Wait, delete bool) ([]DequeuedMessage, error) {
+	if !timeoutInRange(timeout) {
+		return nil, ErrTimeoutOutOfRange
+	}
+	if !waitInRange(wait) {
+		return nil, ErrWaitOutOfRange
+	}
+	if wait > 0 {
+		tmr := time.NewTimer(time.Duration(int(wait)) * time.Second)
+		defer tmr.Stop()
+		select {
+		case <-ctx.Done():
+			return []DequeuedMessage{}, ctx.Err()
+		case <-tmr.C:
+		}
+	}
+	return []DequeuedMessage{}, nil
+}
+
+// DeleteReserved is the interface implementation
+func (n *NoopClient) DeleteReserved(ctx context.Context, token, projID, qName string, messageID int, reservationID string) (*Deleted, error) {
+	return &Deleted{Msg: "deleted"}, nil
+}
+
+// ReleaseReserved is the interface implementation
+func (n *NoopClient) ReleaseReserved(ctx context.Context, token, projID, qName string, messageID int, reservationID string, delay Delay) (*Released, error) {
+	if !delayInRange(delay) {
+		return nil, ErrDelayOutOfRange
+	}
+	return &Released{Msg: "released"}, nil
+}
+
+// TouchReserved is the interface implementation
+func (n *NoopClient) TouchReserved(ctx context.Context, token, projID, qName string, messageID int, reservationID string, timeout Timeout) (*Touched, error) {
+	if !timeoutInRange(timeout) {
+		return nil, ErrTimeoutOutOfRange
+	}
+	return &Touched{ReservationID: reservationID, Msg: "touched"}, nil
+}
+
+// Peek is the interface implementation
+func (n *NoopClient) Peek(ctx context.Context, token, projID, qName string, num int) ([]Message, error) {
+	return []Message{}, nil
+}
+
+// MessageExists is the interface implementation
+func (n *NoopClient) MessageExists(ctx context.Context, token, projID, qName string, messageID int) (bool, error) {
+	return false, nil
+}
+
+// PutQueue is the interface implementation
+func (n *NoopClient) PutQueue(ctx context.Context, token, projID, qName string, cfg QueueConfig) (*QueueInfo, error) {
+	return &QueueInfo{Name: qName, ProjectID: projID}, nil
+}
+
+// GetQueueInfo is the interface implementation
+func (n *NoopClient) GetQueueInfo(ctx context.Context, token, projID, qName string) (*QueueInfo, error) {
+	return &QueueInfo{Name: qName, ProjectID: projID}, nil
+}
@@ -0,0 +1,49 @@
+package mq
+
+import (
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+	"golang.org/x/net/context"
+)
+
+func TestNoopClient(t *testing.T) {
+	var cl Client = NewNoopClient()
+	enq, err := cl.Enqueue(bgCtx, token, projID, qName, []NewMessage{
+		{Body: "abc", PushHeaders: make(map[string]string)},
+		{Body: "def", PushHeaders: make(map[string]string)},
+	})
+	assert.NoErr(t, err)
+	assert.Equal(t, enq.IDs, []string{"1", "2"}, "enqueued IDs")
+	msgs, err := cl.Dequeue(bgCtx, token, projID, qName, 10, Timeout(30), Wait(0), false)
+	assert.NoErr(t, err)
+	assert.Equal(t, len(msgs), 0, "number of dequeued messages")
+	_, err = cl.Dequeue(bgCtx, token, projID, qName, 10, Timeout(0), Wait(0), false)
+	assert.Err(t, ErrTimeoutOutOfRange, err)
+	_, err = cl.DeleteReserved(bgCtx, token, projID, qName, 1, "abc")
+	assert.NoErr(t, err)
+	touched, err := cl.TouchReserved(bgCtx, token, projID, qName, 1, "abc", Timeout(30))
+	assert.NoErr(t, err)
+	assert.Equal(t, touched.ReservationID, "abc", "touched reservation ID")
+	exists, err := cl.MessageExists(bgCtx, token, projID, qName, 1)
+	assert.NoErr(t, err)
+	assert.False(t, exists, "message exists")
+	info, err := cl.GetQueueInfo(bgCtx, token, projID, qName)
+	assert.NoErr(t, err)
+	assert.Equal(t, *info, QueueInfo{Name: qName, ProjectID: projID}, "queue info")
+}
+
+func TestNoopDequeueWaits(t *testing.T) {
+	cl := NewNoopClient()
+	start := time.Now()
+	msgs, err := cl.Dequeue(bgCtx, token, projID, qName, 10, Timeout(30), Wait(1), false)
+	assert.NoErr(t, err)
+	assert.Equal(t, len(msgs), 0, "number of dequeued messages")
+	assert.True(t, time.Since(start) >= time.Second, "Dequeue returned after [%s]", time.Since(start))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = cl.Dequeue(ctx, token, projID, qName, 10, Timeout(30), Wait(30), false)
+	assert.Err(t, context.DeadlineExceeded, err)
+}
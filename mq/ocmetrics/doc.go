@@ -0,0 +1,18 @@
+// Package ocmetrics provides an mq.MetricsRecorder that records IronMQ client measurements to
+// OpenCensus (https://opencensus.io). It lives in its own package so that the mq package doesn't
+// depend on OpenCensus; import it only if you use OpenCensus.
+//
+// Example usage:
+//
+//  import (
+//    "github.com/arschles/gorion/mq"
+//    "github.com/arschles/gorion/mq/ocmetrics"
+//  )
+//
+//  func NewInstrumentedClient(host string) (*mq.HTTPClient, error) {
+//    if err := ocmetrics.RegisterViews(); err != nil {
+//      return nil, err
+//    }
+//    return mq.NewHTTPClient(mq.SchemeHTTPS, host, 443, mq.WithMetricsRecorder(ocmetrics.Recorder{})), nil
+//  }
+package ocmetrics
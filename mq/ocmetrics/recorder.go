@@ -0,0 +1,185 @@
+package ocmetrics
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/arschles/gorion/mq"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+	"golang.org/x/net/context"
+)
+
+var (
+	// KeyOperation tags measurements with the mq.Op* name of the operation they're about
+	KeyOperation = tag.MustNewKey("gorion_operation")
+	// KeyStatus tags request measurements with "ok" or "error"
+	KeyStatus = tag.MustNewKey("gorion_status")
+	// KeyQueue tags reservation measurements with the name of the queue
+	KeyQueue = tag.MustNewKey("gorion_queue")
+	// KeyConnReused tags connection measurements with "true" if the connection was reused and
+	// "false" if it was newly opened
+	KeyConnReused = tag.MustNewKey("gorion_conn_reused")
+)
+
+var (
+	// RequestLatency is the latency of IronMQ API requests
+	RequestLatency = stats.Float64("gorion/request_latency", "Latency of IronMQ API requests", stats.UnitMilliseconds)
+	// RequestErrors is the number of IronMQ API requests that failed
+	RequestErrors = stats.Int64("gorion/request_errors", "Number of failed IronMQ API requests", stats.UnitDimensionless)
+	// ReservedMessages is the number of messages reserved by Dequeue calls
+	ReservedMessages = stats.Int64("gorion/reserved_messages", "Number of reserved messages", stats.UnitDimensionless)
+	// ReservedBytes is the total body size of messages reserved by Dequeue calls
+	ReservedBytes = stats.Int64("gorion/reserved_bytes", "Total body size of reserved messages", stats.UnitBytes)
+	// RedeliveredMessages is the number of reserved messages that were redeliveries
+	RedeliveredMessages = stats.Int64("gorion/redelivered_messages", "Number of redelivered messages", stats.UnitDimensionless)
+	// ProcessingLatency is the time between reserving and deleting messages that consumers processed
+	ProcessingLatency = stats.Float64("gorion/processing_latency", "Time from reserving to deleting processed messages", stats.UnitMilliseconds)
+	// DwellTime is how long reserved messages were in the queue before they were reserved
+	DwellTime = stats.Float64("gorion/dwell_time", "Time reserved messages spent in the queue", stats.UnitMilliseconds)
+	// Conns is the number of connections that IronMQ API requests got
+	Conns = stats.Int64("gorion/conns", "Number of connections obtained for IronMQ API requests", stats.UnitDimensionless)
+)
+
+var (
+	// RequestLatencyView is the distribution of RequestLatency by operation and status
+	RequestLatencyView = &view.View{
+		Name:        "gorion/request_latency",
+		Description: "Latency distribution of IronMQ API requests",
+		Measure:     RequestLatency,
+		TagKeys:     []tag.Key{KeyOperation, KeyStatus},
+		Aggregation: view.Distribution(1, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000, 30000),
+	}
+	// RequestCountView is the number of requests by operation and status
+	RequestCountView = &view.View{
+		Name:        "gorion/request_count",
+		Description: "Number of IronMQ API requests",
+		Measure:     RequestLatency,
+		TagKeys:     []tag.Key{KeyOperation, KeyStatus},
+		Aggregation: view.Count(),
+	}
+	// RequestErrorCountView is the number of failed requests by operation
+	RequestErrorCountView = &view.View{
+		Name:        "gorion/request_error_count",
+		Description: "Number of failed IronMQ API requests",
+		Measure:     RequestErrors,
+		TagKeys:     []tag.Key{KeyOperation},
+		Aggregation: view.Count(),
+	}
+	// ReservedMessagesView is the total number of reserved messages by queue
+	ReservedMessagesView = &view.View{
+		Name:        "gorion/reserved_messages",
+		Description: "Total number of reserved messages",
+		Measure:     ReservedMessages,
+		TagKeys:     []tag.Key{KeyQueue},
+		Aggregation: view.Sum(),
+	}
+	// ReservedBytesView is the total body size of reserved messages by queue
+	ReservedBytesView = &view.View{
+		Name:        "gorion/reserved_bytes",
+		Description: "Total body size of reserved messages",
+		Measure:     ReservedBytes,
+		TagKeys:     []tag.Key{KeyQueue},
+		Aggregation: view.Sum(),
+	}
+	// RedeliveredMessagesView is the total number of redelivered messages by queue
+	RedeliveredMessagesView = &view.View{
+		Name:        "gorion/redelivered_messages",
+		Description: "Total number of redelivered messages",
+		Measure:     RedeliveredMessages,
+		TagKeys:     []tag.Key{KeyQueue},
+		Aggregation: view.Sum(),
+	}
+	// ProcessingLatencyView is the distribution of ProcessingLatency by queue
+	ProcessingLatencyView = &view.View{
+		Name:        "gorion/processing_latency",
+		Description: "Distribution of the time from reserving to deleting processed messages",
+		Measure:     ProcessingLatency,
+		TagKeys:     []tag.Key{KeyQueue},
+		Aggregation: view.Distribution(1, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000, 30000, 60000, 300000),
+	}
+	// DwellTimeView is the distribution of DwellTime by queue
+	DwellTimeView = &view.View{
+		Name:        "gorion/dwell_time",
+		Description: "Distribution of the time reserved messages spent in the queue",
+		Measure:     DwellTime,
+		TagKeys:     []tag.Key{KeyQueue},
+		Aggregation: view.Distribution(10, 50, 100, 250, 500, 1000, 2500, 5000, 10000, 30000, 60000, 300000, 900000, 3600000),
+	}
+	// ConnCountView is the number of connections by operation and whether they were reused
+	ConnCountView = &view.View{
+		Name:        "gorion/conn_count",
+		Description: "Number of connections obtained for IronMQ API requests",
+		Measure:     Conns,
+		TagKeys:     []tag.Key{KeyOperation, KeyConnReused},
+		Aggregation: view.Count(),
+	}
+
+	// DefaultViews are all the views in this package
+	DefaultViews = []*view.View{
+		RequestLatencyView,
+		RequestCountView,
+		RequestErrorCountView,
+		ReservedMessagesView,
+		ReservedBytesView,
+		RedeliveredMessagesView,
+		ProcessingLatencyView,
+		DwellTimeView,
+		ConnCountView,
+	}
+)
+
+// RegisterViews registers DefaultViews with OpenCensus. Measurements are only aggregated and
+// exported for registered views, so call this (or register the views you want yourself)
+// before using a Recorder
+func RegisterViews() error {
+	return view.Register(DefaultViews...)
+}
+
+// Recorder is an mq.MetricsRecorder that records to the measures in this package
+type Recorder struct{}
+
+var _ mq.MetricsRecorder = Recorder{}
+
+// ObserveRequest is the mq.MetricsRecorder implementation
+func (Recorder) ObserveRequest(op string, dur time.Duration, err error) {
+	status := "ok"
+	ms := []stats.Measurement{RequestLatency.M(float64(dur) / float64(time.Millisecond))}
+	if err != nil {
+		status = "error"
+		ms = append(ms, RequestErrors.M(1))
+	}
+	mutators := []tag.Mutator{tag.Upsert(KeyOperation, op), tag.Upsert(KeyStatus, status)}
+	stats.RecordWithTags(context.Background(), mutators, ms...)
+}
+
+// ObserveReserved is the mq.MetricsRecorder implementation
+func (Recorder) ObserveReserved(qName string, num, bytes int) {
+	mutators := []tag.Mutator{tag.Upsert(KeyQueue, qName)}
+	stats.RecordWithTags(context.Background(), mutators, ReservedMessages.M(int64(num)), ReservedBytes.M(int64(bytes)))
+}
+
+// ObserveRedelivered is the mq.MetricsRecorder implementation
+func (Recorder) ObserveRedelivered(qName string, num int) {
+	mutators := []tag.Mutator{tag.Upsert(KeyQueue, qName)}
+	stats.RecordWithTags(context.Background(), mutators, RedeliveredMessages.M(int64(num)))
+}
+
+// ObserveProcessed is the mq.MetricsRecorder implementation
+func (Recorder) ObserveProcessed(qName string, dur time.Duration) {
+	mutators := []tag.Mutator{tag.Upsert(KeyQueue, qName)}
+	stats.RecordWithTags(context.Background(), mutators, ProcessingLatency.M(float64(dur)/float64(time.Millisecond)))
+}
+
+// ObserveConn is the mq.MetricsRecorder implementation
+func (Recorder) ObserveConn(op string, reused bool) {
+	mutators := []tag.Mutator{tag.Upsert(KeyOperation, op), tag.Upsert(KeyConnReused, strconv.FormatBool(reused))}
+	stats.RecordWithTags(context.Background(), mutators, Conns.M(1))
+}
+
+// ObserveDwell is the mq.MetricsRecorder implementation
+func (Recorder) ObserveDwell(qName string, dur time.Duration) {
+	mutators := []tag.Mutator{tag.Upsert(KeyQueue, qName)}
+	stats.RecordWithTags(context.Background(), mutators, DwellTime.M(float64(dur)/float64(time.Millisecond)))
+}
@@ -0,0 +1,52 @@
+package ocmetrics
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+	"go.opencensus.io/stats/view"
+)
+
+func TestRecorder(t *testing.T) {
+	assert.NoErr(t, RegisterViews())
+	defer view.Unregister(DefaultViews...)
+	r := Recorder{}
+	r.ObserveRequest("enqueue", 10*time.Millisecond, nil)
+	r.ObserveRequest("enqueue", 20*time.Millisecond, errors.New("failed"))
+	r.ObserveReserved("q", 2, 15)
+	r.ObserveRedelivered("q", 1)
+	r.ObserveProcessed("q", time.Second)
+	r.ObserveConn("enqueue", false)
+	r.ObserveConn("enqueue", true)
+	r.ObserveConn("enqueue", true)
+	r.ObserveDwell("q", 2*time.Second)
+
+	rows, err := view.RetrieveData(RequestCountView.Name)
+	assert.NoErr(t, err)
+	assert.Equal(t, len(rows), 2, "number of request count rows")
+	rows, err = view.RetrieveData(RequestErrorCountView.Name)
+	assert.NoErr(t, err)
+	assert.Equal(t, len(rows), 1, "number of request error count rows")
+	assert.Equal(t, rows[0].Data.(*view.CountData).Value, int64(1), "number of request errors")
+	rows, err = view.RetrieveData(ReservedBytesView.Name)
+	assert.NoErr(t, err)
+	assert.Equal(t, len(rows), 1, "number of reserved bytes rows")
+	assert.Equal(t, rows[0].Data.(*view.SumData).Value, float64(15), "number of reserved bytes")
+	rows, err = view.RetrieveData(RedeliveredMessagesView.Name)
+	assert.NoErr(t, err)
+	assert.Equal(t, len(rows), 1, "number of redelivered messages rows")
+	assert.Equal(t, rows[0].Data.(*view.SumData).Value, float64(1), "number of redelivered messages")
+	rows, err = view.RetrieveData(ProcessingLatencyView.Name)
+	assert.NoErr(t, err)
+	assert.Equal(t, len(rows), 1, "number of processing latency rows")
+	assert.Equal(t, rows[0].Data.(*view.DistributionData).Count, int64(1), "number of processed messages")
+	rows, err = view.RetrieveData(ConnCountView.Name)
+	assert.NoErr(t, err)
+	assert.Equal(t, len(rows), 2, "number of connection count rows")
+	rows, err = view.RetrieveData(DwellTimeView.Name)
+	assert.NoErr(t, err)
+	assert.Equal(t, len(rows), 1, "number of dwell time rows")
+	assert.Equal(t, rows[0].Data.(*view.DistributionData).Count, int64(1), "number of dwell times")
+}
@@ -0,0 +1,57 @@
+package mq
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"sync"
+)
+
+// maxPooledBufBytes is the capacity above which response buffers aren't returned to the pool, so
+// that a few unusually big responses don't pin a lot of memory
+const maxPooledBufBytes = 1024 * 1024
+
+// bufPool holds the buffers that response bodies are read into before they're decoded. Decoding
+// copies everything it keeps out of the buffer, so buffers can be reused as soon as decoding
+// returns
+var bufPool = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+// getBuf returns an empty buffer from the pool. Return it with putBuf once nothing refers to its
+// contents anymore
+func getBuf() *bytes.Buffer {
+	return bufPool.Get().(*bytes.Buffer)
+}
+
+// putBuf resets buf and returns it to the pool
+func putBuf(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBufBytes {
+		return
+	}
+	buf.Reset()
+	bufPool.Put(buf)
+}
+
+// bufReaderPool holds the readers that response bodies are read through
+var bufReaderPool = sync.Pool{
+	New: func() interface{} {
+		return bufio.NewReader(nil)
+	},
+}
+
+// getBufReader returns a reader from the pool that reads from r. Return it with putBufReader
+// once it's not read from anymore
+func getBufReader(r io.Reader) *bufio.Reader {
+	br := bufReaderPool.Get().(*bufio.Reader)
+	br.Reset(r)
+	return br
+}
+
+// putBufReader detaches br from the reader it was reading from and returns it to the pool
+func putBufReader(br *bufio.Reader) {
+	br.Reset(nil)
+	bufReaderPool.Put(br)
+}
@@ -0,0 +1,122 @@
+package mq
+
+import (
+	"errors"
+	"time"
+
+	"code.google.com/p/go-uuid/uuid"
+	"golang.org/x/net/context"
+)
+
+const (
+	// HeaderReplyTo is the push header that names the queue that the reply to a request message
+	// should be enqueued onto
+	HeaderReplyTo = "X-Gorion-Reply-To"
+	// HeaderCorrelationID is the push header that ties a reply message to the request it answers
+	HeaderCorrelationID = "X-Gorion-Correlation-Id"
+)
+
+var (
+	// ErrNotARequest is returned from Reply when the message has no reply-to or correlation ID
+	// push header
+	ErrNotARequest = errors.New("message is not a request")
+)
+
+const (
+	// replyPollInterval is how long Request waits between reserve requests when it has less than
+	// a second left, which is too short for a reserve request to wait for
+	replyPollInterval = 100 * time.Millisecond
+	// replyBatch is how many messages Request reserves from the reply queue at a time
+	replyBatch = 10
+	// replyReleaseDelay is how long the replies that Request reserved but that aren't for it stay
+	// unavailable after it releases them, so that it doesn't reserve them again right away
+	replyReleaseDelay = Delay(1)
+)
+
+// Request enqueues body onto reqQueue as a request, and then waits up to timeout for the reply to
+// arrive on replyQueue and returns its body. The request names replyQueue in its HeaderReplyTo
+// push header and carries a new ID in its HeaderCorrelationID push header, which the responder
+// copies to the reply, for example with Reply. While waiting, Request reserves the messages on
+// replyQueue a few at a time, deletes the reply once it finds it, and releases every other
+// message with a delay of a second, so replies to other requests sharing the queue can arrive
+// in any order. The delay keeps Request from reserving the same messages over and over, but
+// also holds up the requests they're for by as much. Giving each requester its own reply queue
+// avoids both.
+//
+// Returns nil and the error if the enqueue fails, nil and context.DeadlineExceeded if no reply
+// arrived within timeout, and nil and ctx.Err() if ctx.Done() receives first. Failed reserve or
+// release requests while waiting are also returned.
+//
+// Since replies are matched by their push headers, Request only works with servers that return
+// push headers along with reserved messages
+func Request(ctx context.Context, cl Client, token, projID, reqQueue, replyQueue string, body []byte, timeout time.Duration) ([]byte, error) {
+	corrID := uuid.New()
+	req := NewMessage{
+		Body:        string(body),
+		PushHeaders: map[string]string{HeaderReplyTo: replyQueue, HeaderCorrelationID: corrID},
+	}
+	if _, err := cl.Enqueue(ctx, token, projID, reqQueue, []NewMessage{req}); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	deadline, _ := ctx.Deadline()
+	for {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		// clamped before converting to a Wait, which would overflow if the deadline is long past
+		// or far away
+		remaining := time.Until(deadline)
+		if remaining < 0 {
+			remaining = 0
+		} else if remaining > MaxWait*time.Second {
+			remaining = MaxWait * time.Second
+		}
+		wait := Wait(remaining / time.Second)
+		msgs, err := cl.Dequeue(ctx, token, projID, replyQueue, replyBatch, Timeout(MinTimeout), wait, false)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, err
+		}
+		var reply []byte
+		for _, msg := range msgs {
+			if reply == nil && msg.PushHeaders[HeaderCorrelationID] == corrID {
+				if _, err := cl.DeleteReserved(ctx, token, projID, replyQueue, msg.ID, msg.ReservationID); err != nil {
+					return nil, err
+				}
+				reply = []byte(msg.Body)
+				continue
+			}
+			if _, err := cl.ReleaseReserved(ctx, token, projID, replyQueue, msg.ID, msg.ReservationID, replyReleaseDelay); err != nil {
+				return nil, err
+			}
+		}
+		if reply != nil {
+			return reply, nil
+		}
+		if wait == 0 {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(replyPollInterval):
+			}
+		}
+	}
+}
+
+// Reply enqueues body as the reply to req, a request message that was enqueued with Request,
+// onto the queue in req's HeaderReplyTo push header in the same project. Returns
+// ErrNotARequest if req doesn't have the push headers of a request, or the error from the
+// enqueue. Reply doesn't settle req
+func Reply(ctx context.Context, cl Client, token, projID string, req DequeuedMessage, body []byte) error {
+	replyTo, corrID := req.PushHeaders[HeaderReplyTo], req.PushHeaders[HeaderCorrelationID]
+	if replyTo == "" || corrID == "" {
+		return ErrNotARequest
+	}
+	reply := NewMessage{Body: string(body), PushHeaders: map[string]string{HeaderCorrelationID: corrID}}
+	_, err := cl.Enqueue(ctx, token, projID, replyTo, []NewMessage{reply})
+	return err
+}
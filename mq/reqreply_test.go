@@ -0,0 +1,67 @@
+package mq
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+	"golang.org/x/net/context"
+)
+
+const replyQName = "test-replies"
+
+func TestRequestReply(t *testing.T) {
+	cl := NewMemClient()
+	// a reply to another request that's already waiting on the reply queue
+	_, err := cl.Enqueue(bgCtx, token, projID, replyQName, []NewMessage{
+		{Body: "other", PushHeaders: map[string]string{HeaderCorrelationID: "other"}},
+	})
+	assert.NoErr(t, err)
+	stop := runConsumer(func(ctx context.Context) error {
+		return Consume(ctx, cl, token, projID, qName, consumeOpts, func(ctx context.Context, msg DequeuedMessage, ack *Ack) error {
+			return Reply(ctx, cl, token, projID, msg, []byte(strings.ToUpper(msg.Body)))
+		})
+	})
+	reply, err := Request(bgCtx, cl, token, projID, qName, replyQName, []byte("abc"), 5*time.Second)
+	assert.NoErr(t, err)
+	assert.Equal(t, string(reply), "ABC", "reply body")
+	assert.NoErr(t, stop())
+	// the other reply is back on the queue once its release delay is over, and it wasn't
+	// reserved again while Request waited
+	time.Sleep(time.Duration(int(replyReleaseDelay))*time.Second + 200*time.Millisecond)
+	msgs, err := cl.Peek(bgCtx, token, projID, replyQName, MaxPeek)
+	assert.NoErr(t, err)
+	assert.Equal(t, len(msgs), 1, "number of messages left on the reply queue")
+	assert.Equal(t, msgs[0].Body, "other", "body of the message left on the reply queue")
+	assert.Equal(t, msgs[0].ReservedCount, 1, "reserved count of the other reply")
+}
+
+// slowReplyClient is a Client whose Dequeue takes longer than its context allows, ignoring it,
+// and records the waits it was called with
+type slowReplyClient struct {
+	NoopClient
+	delay time.Duration
+	waits []Wait
+}
+
+func (s *slowReplyClient) Dequeue(ctx context.Context, token, projID, qName string, num int, timeout Timeout, wait Wait, delete bool) ([]DequeuedMessage, error) {
+	s.waits = append(s.waits, wait)
+	time.Sleep(s.delay)
+	return nil, nil
+}
+
+func TestRequestOverrunsDeadline(t *testing.T) {
+	// the first reserve request waits a second, and returns more than a second after the deadline
+	cl := &slowReplyClient{delay: 2200 * time.Millisecond}
+	_, err := Request(bgCtx, cl, token, projID, qName, replyQName, []byte("abc"), 1100*time.Millisecond)
+	assert.Err(t, context.DeadlineExceeded, err)
+	assert.Equal(t, cl.waits, []Wait{1}, "waits of the reserve requests")
+}
+
+func TestRequestTimeout(t *testing.T) {
+	cl := NewMemClient()
+	_, err := Request(bgCtx, cl, token, projID, qName, replyQName, []byte("abc"), 50*time.Millisecond)
+	assert.Err(t, context.DeadlineExceeded, err)
+	assert.Err(t, ErrNotARequest, Reply(bgCtx, cl, token, projID, DequeuedMessage{Body: "abc"}, nil))
+}
@@ -0,0 +1,97 @@
+package mq
+
+import (
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// retryPolicy determines how many times and how often a failed request is retried
+type retryPolicy struct {
+	// max is the maximum number of retries after the first attempt. 0 means never retry
+	max int
+	// backoff is how long to wait before the first retry. It doubles on each subsequent retry
+	backoff time.Duration
+}
+
+// wait blocks until it's time to make the retry after the given (zero-based) attempt. Returns
+// ctx.Err() if ctx.Done() receives before then
+func (r retryPolicy) wait(ctx context.Context, attempt int) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(r.backoff << uint(attempt)):
+		return nil
+	}
+}
+
+// retryable returns true if err is retryable according to the package-level retryable, or if
+// it's an *HTTPError that the client's retryable message predicate accepts
+func (h *HTTPClient) retryable(err error) bool {
+	if retryable(err) {
+		return true
+	}
+	httpErr, ok := err.(*HTTPError)
+	return ok && h.retryableMsg != nil && h.retryableMsg(httpErr.StatusCode, httpErr.Msg)
+}
+
+// retryable returns true if err is a transient failure that might not recur if the request
+// is made again. These are connection errors and 5xx or 429 responses
+func retryable(err error) bool {
+	switch e := err.(type) {
+	case *HTTPError:
+		return e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests
+	case *url.Error:
+		return e.Err != context.Canceled && e.Err != context.DeadlineExceeded
+	default:
+		return false
+	}
+}
+
+type retryBudgetKey struct{}
+
+// WithRetryBudget returns a copy of ctx that carries a budget of n retries. Every retry an
+// HTTPClient makes for a request with the returned context, or any context derived from it,
+// spends one retry from the budget, and once it's spent, failed requests aren't retried even if
+// the client's own retry policy would allow it. Outer layers that retry on their own can spend
+// from the same budget with SpendRetry, so that retries don't multiply across layers. Without a
+// budget in the context, each request is retried according to the client's policy alone
+func WithRetryBudget(ctx context.Context, n int) context.Context {
+	remaining := int64(n)
+	return context.WithValue(ctx, retryBudgetKey{}, &remaining)
+}
+
+// RetryBudgetRemaining returns the number of retries left in ctx's retry budget, and false if
+// ctx doesn't carry one
+func RetryBudgetRemaining(ctx context.Context) (int, bool) {
+	remaining, ok := ctx.Value(retryBudgetKey{}).(*int64)
+	if !ok {
+		return 0, false
+	}
+	n := atomic.LoadInt64(remaining)
+	if n < 0 {
+		n = 0
+	}
+	return int(n), true
+}
+
+// SpendRetry spends one retry from ctx's retry budget and returns true, or returns false if the
+// budget is already spent. Always returns true if ctx doesn't carry a budget
+func SpendRetry(ctx context.Context) bool {
+	remaining, ok := ctx.Value(retryBudgetKey{}).(*int64)
+	if !ok {
+		return true
+	}
+	for {
+		n := atomic.LoadInt64(remaining)
+		if n <= 0 {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(remaining, n, n-1) {
+			return true
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package mq
+
+import (
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+	"github.com/arschles/testsrv"
+)
+
+// flakyDeleteHandler responds to the first DELETE with a 503 and all later ones with a 404, as
+// if the first delete was applied but its response was lost
+func flakyDeleteHandler() http.Handler {
+	var numReqs int32
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&numReqs, 1) == 1 {
+			http.Error(w, `{"msg":"Service Unavailable"}`, http.StatusServiceUnavailable)
+			return
+		}
+		http.Error(w, `{"msg":"Message not found"}`, http.StatusNotFound)
+	})
+}
+
+func TestDeleteReservedRetryNotFound(t *testing.T) {
+	srv := testsrv.StartServer(flakyDeleteHandler())
+	defer srv.Close()
+	cl := newTestHTTPClient(t, srv, WithDeleteRetries(2, time.Millisecond))
+	deleted, err := cl.DeleteReserved(bgCtx, token, projID, qName, 1, "abc")
+	assert.NoErr(t, err)
+	assert.Equal(t, deleted.Msg, "Message not found", "deleted message")
+	assert.Equal(t, len(srv.AcceptN(2, 100*time.Millisecond)), 2, "number of requests")
+}
+
+func TestDeleteReservedNoRetries(t *testing.T) {
+	srv := testsrv.StartServer(flakyDeleteHandler())
+	defer srv.Close()
+	cl := newTestHTTPClient(t, srv)
+	_, err := cl.DeleteReserved(bgCtx, token, projID, qName, 1, "abc")
+	httpErr, ok := err.(*HTTPError)
+	assert.True(t, ok, "returned error [%s] was not an *HTTPError", err)
+	assert.Equal(t, httpErr.StatusCode, http.StatusServiceUnavailable, "status code")
+	assert.Equal(t, len(srv.AcceptN(2, 100*time.Millisecond)), 1, "number of requests")
+}
+
+func TestDeleteReservedNotFoundFirstAttempt(t *testing.T) {
+	srv := testsrv.StartServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"msg":"Message not found"}`, http.StatusNotFound)
+	}))
+	defer srv.Close()
+	cl := newTestHTTPClient(t, srv, WithDeleteRetries(2, time.Millisecond))
+	_, err := cl.DeleteReserved(bgCtx, token, projID, qName, 1, "abc")
+	httpErr, ok := err.(*HTTPError)
+	assert.True(t, ok, "returned error [%s] was not an *HTTPError", err)
+	assert.Equal(t, httpErr.StatusCode, http.StatusNotFound, "status code")
+}
+
+func TestDeleteReservedRetryableMsg(t *testing.T) {
+	var numReqs int32
+	srv := testsrv.StartServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&numReqs, 1) == 1 {
+			http.Error(w, `{"msg":"Queue is being modified"}`, http.StatusConflict)
+			return
+		}
+		w.Write([]byte(`{"msg":"Deleted"}`))
+	}))
+	defer srv.Close()
+	cl := newTestHTTPClient(t, srv, WithDeleteRetries(2, time.Millisecond))
+	_, err := cl.DeleteReserved(bgCtx, token, projID, qName, 1, "abc")
+	httpErr, ok := err.(*HTTPError)
+	assert.True(t, ok, "returned error [%s] was not an *HTTPError", err)
+	assert.Equal(t, httpErr.StatusCode, http.StatusConflict, "status code")
+
+	atomic.StoreInt32(&numReqs, 0)
+	cl = newTestHTTPClient(t, srv, WithDeleteRetries(2, time.Millisecond), WithRetryableMsg(func(status int, msg string) bool {
+		return status == http.StatusConflict && strings.Contains(msg, "being modified")
+	}))
+	deleted, err := cl.DeleteReserved(bgCtx, token, projID, qName, 1, "abc")
+	assert.NoErr(t, err)
+	assert.Equal(t, deleted.Msg, "Deleted", "deleted message")
+}
+
+func TestRetryBudget(t *testing.T) {
+	_, ok := RetryBudgetRemaining(bgCtx)
+	assert.False(t, ok, "background context had a retry budget")
+	assert.True(t, SpendRetry(bgCtx), "couldn't spend a retry without a budget")
+
+	srv := testsrv.StartServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"msg":"Service Unavailable"}`, http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	cl := newTestHTTPClient(t, srv, WithDeleteRetries(5, time.Millisecond))
+	ctx := WithRetryBudget(bgCtx, 3)
+	assert.True(t, SpendRetry(ctx), "couldn't spend a retry from the budget")
+	_, err := cl.DeleteReserved(ctx, token, projID, qName, 1, "abc")
+	_, ok = err.(*HTTPError)
+	assert.True(t, ok, "returned error [%s] was not an *HTTPError", err)
+	// the first attempt and the two retries left in the budget
+	assert.Equal(t, len(srv.AcceptN(6, 100*time.Millisecond)), 3, "number of requests")
+	remaining, ok := RetryBudgetRemaining(ctx)
+	assert.True(t, ok, "context had no retry budget")
+	assert.Equal(t, remaining, 0, "remaining retries")
+	assert.False(t, SpendRetry(ctx), "spent a retry from an exhausted budget")
+}
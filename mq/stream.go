@@ -0,0 +1,149 @@
+package mq
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// streamReleaseTimeout is how long a stream spends releasing its unacked messages after its
+// context is done
+const streamReleaseTimeout = 10 * time.Second
+
+type stream struct {
+	cl     Client
+	token  string
+	projID string
+	qName  string
+	opts   ConsumeOptions
+
+	mtx  sync.Mutex
+	held map[int]*autoTouch
+}
+
+// Stream reserves messages from qName in the background and returns a channel that delivers
+// them, along with a func that acks a delivered message by deleting it from the queue. It's
+// intended for processing pipelines built on channels.
+//
+// Every message stays reserved until it's acked: Stream touches it every half of opts.Timeout,
+// jittered by opts.TouchJitter, both while it's waiting in the channel and after it was
+// received. Messages are reserved opts.Num at a time, and the next batch isn't reserved until
+// the current one was received from the channel. When ctx.Done() receives, messages that
+// weren't acked yet are released back onto the queue and then the channel is closed. Failed
+// reserve, touch and release requests are passed to opts.OnError, and reserve requests are
+// retried after a second.
+//
+// The ack func returns ErrNoSuchReservation if the message isn't held by the stream, for example
+// because it was already acked or released, or the error from DeleteReserved.
+//
+// Returns ErrTimeoutOutOfRange or ErrWaitOutOfRange immediately if opts.Timeout or opts.Wait are
+// out of range. opts.OnDecodeError, opts.DeadLetterQueue, opts.Codecs, opts.HandlerTimeout,
+// opts.ManualAck, opts.MaxMsgsPerSec, opts.GlobalMaxInFlight, opts.OnReservationExpiring,
+// opts.ReservationExpiringWithin and opts.Metrics are ignored
+func Stream(ctx context.Context, cl Client, token, projID, qName string, opts ConsumeOptions) (<-chan DequeuedMessage, func(DequeuedMessage) error, error) {
+	if !timeoutInRange(opts.Timeout) {
+		return nil, nil, ErrTimeoutOutOfRange
+	}
+	if !waitInRange(opts.Wait) {
+		return nil, nil, ErrWaitOutOfRange
+	}
+	s := &stream{cl: cl, token: token, projID: projID, qName: qName, opts: opts, held: make(map[int]*autoTouch)}
+	ch := make(chan DequeuedMessage)
+	go func() {
+		s.run(ctx, ch)
+		s.releaseAll()
+		close(ch)
+	}()
+	return ch, s.ack, nil
+}
+
+func (s *stream) onError(err error) {
+	if s.opts.OnError != nil {
+		s.opts.OnError(err)
+	}
+}
+
+func (s *stream) run(ctx context.Context, ch chan<- DequeuedMessage) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+		msgs, err := s.cl.Dequeue(ctx, s.token, s.projID, s.qName, s.opts.num(), s.opts.Timeout, s.opts.Wait, false)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			s.onError(err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(consumeErrBackoff):
+			}
+			continue
+		}
+		for _, msg := range msgs {
+			s.hold(ctx, msg)
+		}
+		for _, msg := range msgs {
+			select {
+			case ch <- msg:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// hold starts touching msg and records it as unacked
+func (s *stream) hold(ctx context.Context, msg DequeuedMessage) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.held[msg.ID] = startAutoTouch(ctx, s.cl, s.token, s.projID, s.qName, msg, s.opts.Timeout, touchInterval(s.opts.Timeout), s.opts.TouchJitter, s.onError)
+}
+
+// take stops touching the message with the given ID and returns it with its current reservation
+// ID, or false if it isn't held
+func (s *stream) take(id int) (DequeuedMessage, bool) {
+	s.mtx.Lock()
+	a, ok := s.held[id]
+	delete(s.held, id)
+	s.mtx.Unlock()
+	if !ok {
+		return DequeuedMessage{}, false
+	}
+	return a.stop(), true
+}
+
+func (s *stream) ack(msg DequeuedMessage) error {
+	held, ok := s.take(msg.ID)
+	if !ok {
+		return ErrNoSuchReservation
+	}
+	_, err := s.cl.DeleteReserved(context.Background(), s.token, s.projID, s.qName, held.ID, held.ReservationID)
+	return err
+}
+
+// releaseAll releases every message that's still held
+func (s *stream) releaseAll() {
+	s.mtx.Lock()
+	ids := make([]int, 0, len(s.held))
+	for id := range s.held {
+		ids = append(ids, id)
+	}
+	s.mtx.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), streamReleaseTimeout)
+	defer cancel()
+	for _, id := range ids {
+		msg, ok := s.take(id)
+		if !ok {
+			continue
+		}
+		if _, err := s.cl.ReleaseReserved(ctx, s.token, s.projID, s.qName, msg.ID, msg.ReservationID, 0); err != nil {
+			s.onError(err)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package mq
+
+import (
+	"testing"
+
+	"github.com/arschles/assert"
+	"golang.org/x/net/context"
+)
+
+func TestStream(t *testing.T) {
+	cl := NewMemClient()
+	enqueueBodies(t, cl, "abc", "def")
+	ctx, cancel := context.WithCancel(context.Background())
+	ch, ack, err := Stream(ctx, cl, token, projID, qName, consumeOpts)
+	assert.NoErr(t, err)
+	first := <-ch
+	assert.Equal(t, first.Body, "abc", "first message body")
+	second := <-ch
+	assert.Equal(t, second.Body, "def", "second message body")
+	assert.NoErr(t, ack(first))
+	assert.Err(t, ErrNoSuchReservation, ack(first))
+
+	cancel()
+	for range ch {
+	}
+	// after the channel closes the unacked message must be back on the queue
+	msgs, err := cl.Peek(bgCtx, token, projID, qName, MaxPeek)
+	assert.NoErr(t, err)
+	assert.Equal(t, len(msgs), 1, "number of available messages")
+	assert.Equal(t, msgs[0].ID, second.ID, "available message ID")
+	assert.Err(t, ErrNoSuchReservation, ack(second))
+}
+
+func TestStreamInvalidOptions(t *testing.T) {
+	opts := consumeOpts
+	opts.Timeout = MaxTimeout + 1
+	_, _, err := Stream(bgCtx, NewMemClient(), token, projID, qName, opts)
+	assert.Err(t, ErrTimeoutOutOfRange, err)
+}
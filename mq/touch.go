@@ -0,0 +1,131 @@
+package mq
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// maxTouchJitter is the most that touch intervals are jittered by, as a fraction of the interval.
+// It keeps a jittered touch of a reservation that's touched every half of its timeout at least
+// three eighths of the timeout before the reservation expires
+const maxTouchJitter = 0.25
+
+// touchInterval returns how often a reservation with the given timeout is touched to keep it
+// alive. Touching at half the timeout leaves room for a slow touch request, since a jittered
+// interval is at most maxTouchJitter longer
+func touchInterval(timeout Timeout) time.Duration {
+	return time.Duration(int(timeout)) * time.Second / 2
+}
+
+// jittered returns a random duration within jitter times d of d. jitter is clamped to
+// [0, maxTouchJitter]
+func jittered(d time.Duration, jitter float64) time.Duration {
+	if jitter <= 0 {
+		return d
+	}
+	if jitter > maxTouchJitter {
+		jitter = maxTouchJitter
+	}
+	return time.Duration(float64(d) * (1 + jitter*(2*rand.Float64()-1)))
+}
+
+// autoTouch keeps the reservation of a reserved message alive by touching it every interval,
+// until it's stopped or a touch fails
+type autoTouch struct {
+	cl       Client
+	token    string
+	projID   string
+	qName    string
+	timeout  Timeout
+	interval time.Duration
+	jitter   float64
+	onError  func(error)
+
+	// held while touching, so that stop never returns a reservation ID that's about to change
+	mtx       sync.Mutex
+	msg       DequeuedMessage
+	touchedAt time.Time
+	stopped   bool
+	stopCh    chan struct{}
+}
+
+// startAutoTouch starts touching msg every interval, randomly lengthened or shortened by up to
+// jitter times interval each time, with the given timeout. Touching continues until ctx.Done()
+// receives or the returned autoTouch is stopped. Failed touches are passed to onError, which
+// may be nil, and end the touching
+func startAutoTouch(ctx context.Context, cl Client, token, projID, qName string, msg DequeuedMessage, timeout Timeout, interval time.Duration, jitter float64, onError func(error)) *autoTouch {
+	a := &autoTouch{
+		cl:        cl,
+		token:     token,
+		projID:    projID,
+		qName:     qName,
+		timeout:   timeout,
+		interval:  interval,
+		jitter:    jitter,
+		onError:   onError,
+		msg:       msg,
+		touchedAt: time.Now(),
+		stopCh:    make(chan struct{}),
+	}
+	go a.run(ctx)
+	return a
+}
+
+func (a *autoTouch) run(ctx context.Context) {
+	for {
+		tmr := time.NewTimer(jittered(a.interval, a.jitter))
+		select {
+		case <-ctx.Done():
+			tmr.Stop()
+			return
+		case <-a.stopCh:
+			tmr.Stop()
+			return
+		case <-tmr.C:
+		}
+		if err := a.touch(ctx); err != nil {
+			if a.onError != nil && ctx.Err() == nil {
+				a.onError(err)
+			}
+			return
+		}
+	}
+}
+
+func (a *autoTouch) touch(ctx context.Context) error {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	if a.stopped {
+		return nil
+	}
+	touched, err := a.cl.TouchReserved(ctx, a.token, a.projID, a.qName, a.msg.ID, a.msg.ReservationID, a.timeout)
+	if err != nil {
+		return err
+	}
+	a.msg.ReservationID = touched.ReservationID
+	a.touchedAt = time.Now()
+	return nil
+}
+
+// lastTouched returns when the reservation was last extended, or when touching started if it
+// wasn't touched yet
+func (a *autoTouch) lastTouched() time.Time {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	return a.touchedAt
+}
+
+// stop stops touching the message and returns it with its current reservation ID. It's safe to
+// call more than once
+func (a *autoTouch) stop() DequeuedMessage {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	if !a.stopped {
+		a.stopped = true
+		close(a.stopCh)
+	}
+	return a.msg
+}
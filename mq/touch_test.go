@@ -0,0 +1,48 @@
+package mq
+
+import (
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+	"golang.org/x/net/context"
+)
+
+func TestAutoTouch(t *testing.T) {
+	cl := NewMemClient()
+	enqueueBodies(t, cl, "abc")
+	msgs, err := cl.Dequeue(bgCtx, token, projID, qName, 1, Timeout(30), Wait(1), false)
+	assert.NoErr(t, err)
+	assert.Equal(t, len(msgs), 1, "number of dequeued messages")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errCh := make(chan error, 1)
+	a := startAutoTouch(ctx, cl, token, projID, qName, msgs[0], Timeout(30), 10*time.Millisecond, 0.5, func(err error) {
+		errCh <- err
+	})
+	time.Sleep(50 * time.Millisecond)
+	msg := a.stop()
+	assert.Equal(t, msg.ID, msgs[0].ID, "message ID")
+	assert.True(t, msg.ReservationID != msgs[0].ReservationID, "reservation ID didn't change")
+	select {
+	case err := <-errCh:
+		t.Fatalf("touch failed [%s]", err)
+	default:
+	}
+	_, err = cl.DeleteReserved(bgCtx, token, projID, qName, msg.ID, msg.ReservationID)
+	assert.NoErr(t, err)
+}
+
+func TestJittered(t *testing.T) {
+	assert.Equal(t, jittered(time.Second, 0), time.Second, "interval without jitter")
+	for i := 0; i < 100; i++ {
+		d := jittered(time.Second, 0.2)
+		assert.True(t, d >= 800*time.Millisecond && d <= 1200*time.Millisecond, "jittered interval [%s] out of range", d)
+		d = jittered(time.Second, 5)
+		assert.True(t, d >= 750*time.Millisecond && d <= 1250*time.Millisecond, "interval with clamped jitter [%s] out of range", d)
+		// a jittered touch always comes well before the reservation expires
+		timeout := Timeout(30)
+		d = jittered(touchInterval(timeout), 1)
+		assert.True(t, d <= time.Duration(int(timeout))*time.Second*5/8, "touch interval [%s] too close to timeout [%d]", d, timeout)
+	}
+}
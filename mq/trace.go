@@ -0,0 +1,36 @@
+package mq
+
+import "golang.org/x/net/context"
+
+const (
+	// HeaderTraceparent is the W3C Trace Context (https://www.w3.org/TR/trace-context/) header that identifies the current span
+	HeaderTraceparent = "traceparent"
+	// HeaderTracestate is the W3C Trace Context header that carries vendor-specific trace state
+	HeaderTracestate = "tracestate"
+)
+
+// TraceInjector writes the trace context of the span that's active in ctx into headers, using
+// keys like HeaderTraceparent. With OpenTelemetry, for example, it can be:
+//
+//	func(ctx context.Context, headers map[string]string) {
+//	  otel.GetTextMapPropagator().Inject(ctx, propagation.MapCarrier(headers))
+//	}
+type TraceInjector func(ctx context.Context, headers map[string]string)
+
+// TraceHeaders returns the W3C Trace Context headers among msg's push headers, so that the
+// trace context can be extracted with the tracing library of your choice. With OpenTelemetry,
+// for example:
+//
+//	ctx = otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(mq.TraceHeaders(msg)))
+//
+// Returns an empty map if msg has no trace headers, which is always the case if the server
+// didn't return push headers with the message
+func TraceHeaders(msg DequeuedMessage) map[string]string {
+	ret := make(map[string]string)
+	for _, key := range []string{HeaderTraceparent, HeaderTracestate} {
+		if val, ok := msg.PushHeaders[key]; ok {
+			ret[key] = val
+		}
+	}
+	return ret
+}
@@ -0,0 +1,36 @@
+package mq
+
+import (
+	"testing"
+
+	"github.com/arschles/assert"
+	"github.com/arschles/testsrv"
+	"golang.org/x/net/context"
+)
+
+type traceCtxKey struct{}
+
+func TestTracePropagation(t *testing.T) {
+	srv := testsrv.StartServer(makeQHandler())
+	defer srv.Close()
+	inject := func(ctx context.Context, headers map[string]string) {
+		headers[HeaderTraceparent] = ctx.Value(traceCtxKey{}).(string)
+	}
+	cl := newTestHTTPClient(t, srv, WithTracePropagation(inject))
+	traceparent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	ctx := context.WithValue(bgCtx, traceCtxKey{}, traceparent)
+	headers := map[string]string{"a": "b"}
+	_, err := cl.Enqueue(ctx, token, projID, qName, []NewMessage{{Body: "abc", PushHeaders: headers}})
+	assert.NoErr(t, err)
+	assert.Equal(t, headers, map[string]string{"a": "b"}, "push headers passed to Enqueue")
+
+	msgs, err := cl.Dequeue(bgCtx, token, projID, qName, 1, Timeout(30), Wait(1), false)
+	assert.NoErr(t, err)
+	assert.Equal(t, len(msgs), 1, "number of dequeued messages")
+	assert.Equal(t, msgs[0].PushHeaders, map[string]string{"a": "b", HeaderTraceparent: traceparent}, "dequeued push headers")
+	assert.Equal(t, TraceHeaders(msgs[0]), map[string]string{HeaderTraceparent: traceparent}, "trace headers")
+}
+
+func TestTraceHeadersMissing(t *testing.T) {
+	assert.Equal(t, TraceHeaders(DequeuedMessage{ID: 1}), map[string]string{}, "trace headers")
+}